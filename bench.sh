@@ -0,0 +1,11 @@
+#!/usr/bin/env bash
+# Runs the benchmarks and compares them with bench_baseline.txt, pass -update
+# to make the run the new baseline.
+go test -run '^$' -bench . -benchmem -count 5 | tee bench_output.txt || exit 1
+if [ "$1" == "-update" ]; then
+    cp bench_output.txt bench_baseline.txt
+elif command -v benchstat > /dev/null; then
+    benchstat bench_baseline.txt bench_output.txt
+else
+    echo "install golang.org/x/perf/cmd/benchstat to compare with bench_baseline.txt"
+fi
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// The benchmarks run on every bundled move request. Compare a change against
+// bench_baseline.txt with bench.sh, and regenerate the baseline with it when a
+// change is meant to move the numbers.
+
+var bench_fixtures = []string{"test_request.json", "request.json", "survival_request.json"}
+
+// bench_tree is a single worker tree for the fixture with its root expanded.
+func bench_tree(b *testing.B, fixture string) *Tree {
+	tree := new_tree(fixture_state(b, fixture), config)
+	tree.configure()
+	tree.workers = 1
+	tree.deadline = time.Now().Add(time.Hour)
+	tree.reseed(1)
+	if err := tree.root.expandNode(); err != nil {
+		b.Fatal(err)
+	}
+	return tree
+}
+
+// report_playouts adds the rate of play outs to the benchmark's results.
+func report_playouts(b *testing.B, playouts int, start time.Time) {
+	b.ReportMetric(float64(playouts)/time.Since(start).Seconds(), "playouts/s")
+}
+
+func BenchmarkSimulationCopy(b *testing.B) {
+	for _, fixture := range bench_fixtures {
+		b.Run(fixture, func(b *testing.B) {
+			state := fixture_state(b, fixture)
+			sim := simulationFromGame(&state)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sim.copy()
+			}
+		})
+	}
+}
+
+// BenchmarkExecuteAction plays a whole rotation, one executeAction per snake.
+// Each rotation starts from a fresh copy, which isn't timed.
+func BenchmarkExecuteAction(b *testing.B) {
+	for _, fixture := range bench_fixtures {
+		b.Run(fixture, func(b *testing.B) {
+			tree := bench_tree(b, fixture)
+			sim := tree.root.board
+			order := tree.root.player_arr
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				board := sim.copy()
+				b.StartTimer()
+				for j, id := range order {
+					move := board.getValidMoves(id)[0]
+					_, next, err := board.executeAction(move, j == len(order)-1)
+					if err != nil {
+						b.Fatal(err)
+					}
+					board.board = *next
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetValidMoves(b *testing.B) {
+	for _, fixture := range bench_fixtures {
+		b.Run(fixture, func(b *testing.B) {
+			state := fixture_state(b, fixture)
+			sim := simulationFromGame(&state)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sim.getValidMoves(state.You.ID)
+			}
+		})
+	}
+}
+
+func BenchmarkPlayOut(b *testing.B) {
+	for _, fixture := range bench_fixtures {
+		for _, engine := range []string{ENGINE_RULES, ENGINE_FAST} {
+			b.Run(fixture+"/"+engine, func(b *testing.B) {
+				tree := bench_tree(b, fixture)
+				tree.config.engine = engine
+				node := tree.root.children[0]
+				settings := tree.rollout_settings(rand.New(rand.NewSource(1)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					board, err := node.simulation()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := node.play_out(board, settings); err != nil {
+						b.Fatal(err)
+					}
+				}
+				report_playouts(b, b.N, start)
+			})
+		}
+	}
+}
+
+// BenchmarkExpandTree runs search iterations on a growing tree, as a search
+// does: selection, expansion, a play out and back propagation each.
+func BenchmarkExpandTree(b *testing.B) {
+	for _, fixture := range bench_fixtures {
+		b.Run(fixture, func(b *testing.B) {
+			tree := bench_tree(b, fixture)
+			rng := worker_rand(tree.seed, 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := tree.expand_tree(rng); err != nil {
+					b.Fatal(err)
+				}
+			}
+			report_playouts(b, b.N, start)
+		})
+	}
+}
+
+// BenchmarkMonteMove is a whole move of BENCH_ITERATIONS simulations on a
+// fresh tree.
+func BenchmarkMonteMove(b *testing.B) {
+	const BENCH_ITERATIONS = 200
+	for _, fixture := range bench_fixtures {
+		b.Run(fixture, func(b *testing.B) {
+			state := fixture_state(b, fixture)
+			settings := config
+			settings.iterations = BENCH_ITERATIONS
+			settings.workers = 1
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				tree := new_tree(state, settings)
+				tree.deadline = time.Now().Add(time.Hour)
+				tree.reseed(int64(i) + 1)
+				if _, err := tree.monte_move(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			report_playouts(b, b.N*BENCH_ITERATIONS, start)
+		})
+	}
+}
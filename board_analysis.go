@@ -0,0 +1,243 @@
+package main
+
+import (
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// getValidMoves only looks one cell ahead, so on its own the snake walks into
+// pockets it can't get out of. BoardAnalysis looks at the free space of the
+// whole board: how big each open region is, which cells are chokepoints
+// splitting a region in two, and which cells open up as tails move away.
+
+type BoardAnalysis struct {
+	width   int
+	height  int
+	wrapped bool
+
+	// free_at is the first turn each cell is free to move into: 0 for empty
+	// cells and for a body segment the turn it has moved past, so a tail
+	// is free next turn unless it is stacked.
+	free_at []int
+
+	// component numbers the open region of every free cell, -1 for cells
+	// that aren't free, and sizes holds the size of each region.
+	component []int
+	sizes     []int
+
+	// cut marks the articulation points, cells that split their region when
+	// they are filled. beyond is the largest part of the region left to a
+	// snake that moves into a cut cell.
+	cut    []bool
+	beyond []int
+}
+
+func analyse_board(sim *Simulation) *BoardAnalysis {
+	board := &sim.board
+	cells := board.Width * board.Height
+	analysis := &BoardAnalysis{
+		width:     board.Width,
+		height:    board.Height,
+		wrapped:   sim.ruleset == rules.GameTypeWrapped,
+		free_at:   free_times(board),
+		component: make([]int, cells),
+		cut:       make([]bool, cells),
+		beyond:    make([]int, cells),
+	}
+
+	order := make([]int, cells)
+	low := make([]int, cells)
+	size := make([]int, cells)
+	parted := make([]int, cells)
+	for cell := range analysis.component {
+		analysis.component[cell] = -1
+		order[cell] = -1
+	}
+	for cell := range analysis.component {
+		if analysis.free(cell) && analysis.component[cell] == -1 {
+			analysis.find_cuts(cell, order, low, size, parted)
+		}
+	}
+	return analysis
+}
+
+// free_times is BoardAnalysis.free_at for the board, indexed by y*width+x.
+func free_times(board *rules.BoardState) []int {
+	free_at := make([]int, board.Width*board.Height)
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		for i, body := range snake.Body {
+			if body.X < 0 || body.X >= board.Width || body.Y < 0 || body.Y >= board.Height {
+				continue
+			}
+			cell := body.Y*board.Width + body.X
+			free_at[cell] = max_int(free_at[cell], len(snake.Body)-i)
+		}
+	}
+	return free_at
+}
+
+func (analysis *BoardAnalysis) in_bounds(p rules.Point) bool {
+	return p.X >= 0 && p.X < analysis.width && p.Y >= 0 && p.Y < analysis.height
+}
+
+func (analysis *BoardAnalysis) index(p rules.Point) int {
+	return p.Y*analysis.width + p.X
+}
+
+func (analysis *BoardAnalysis) free(cell int) bool {
+	return analysis.free_at[cell] <= 1
+}
+
+// neighbours are the cells next to cell that are on the board.
+func (analysis *BoardAnalysis) neighbours(cell int) []int {
+	point := rules.Point{X: cell % analysis.width, Y: cell / analysis.width}
+	next := make([]int, 0, 4)
+	for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+		p := move_point(point, dir)
+		if analysis.wrapped {
+			p.X = (p.X + analysis.width) % analysis.width
+			p.Y = (p.Y + analysis.height) % analysis.height
+		}
+		if analysis.in_bounds(p) {
+			next = append(next, analysis.index(p))
+		}
+	}
+	return next
+}
+
+// find_cuts labels the region around start and finds its articulation points
+// with Tarjan's depth first search. A cell is a cut when the subtree below one
+// of its children has no edge back above it, that subtree is then a part of
+// the region only reachable through the cell. order must start out as -1 for
+// every cell, the other slices are scratch space of the same size.
+func (analysis *BoardAnalysis) find_cuts(start int, order []int, low []int, size []int, parted []int) {
+	region := len(analysis.sizes)
+	analysis.sizes = append(analysis.sizes, 0)
+	found := []int{}
+
+	var visit func(cell int, parent int)
+	visit = func(cell int, parent int) {
+		order[cell] = len(found)
+		low[cell] = order[cell]
+		size[cell] = 1
+		parted[cell] = 0
+		analysis.component[cell] = region
+		found = append(found, cell)
+		children := 0
+
+		for _, next := range analysis.neighbours(cell) {
+			if !analysis.free(next) || next == parent {
+				continue
+			}
+			if order[next] != -1 {
+				low[cell] = min_int(low[cell], order[next])
+				continue
+			}
+			visit(next, cell)
+			children += 1
+			size[cell] += size[next]
+			low[cell] = min_int(low[cell], low[next])
+			if parent == -1 || low[next] >= order[cell] {
+				analysis.beyond[cell] = max_int(analysis.beyond[cell], size[next])
+				parted[cell] += size[next]
+			}
+			if parent != -1 && low[next] >= order[cell] {
+				analysis.cut[cell] = true
+			}
+		}
+		if parent == -1 && children > 1 {
+			analysis.cut[cell] = true
+		}
+	}
+	visit(start, -1)
+
+	// The rest of the region, above the cut, is a part of its own.
+	analysis.sizes[region] = len(found)
+	for _, cell := range found {
+		if analysis.cut[cell] {
+			analysis.beyond[cell] = max_int(analysis.beyond[cell], len(found)-1-parted[cell])
+		}
+	}
+}
+
+// room is how much of the board a snake moving into p can still get to, not
+// counting tails that move away later. Moving into a cut cell commits the
+// snake to one side of it.
+func (analysis *BoardAnalysis) room(p rules.Point) int {
+	if !analysis.in_bounds(p) || !analysis.free(analysis.index(p)) {
+		return 0
+	}
+	cell := analysis.index(p)
+	if analysis.cut[cell] {
+		return 1 + analysis.beyond[cell]
+	}
+	return analysis.sizes[analysis.component[cell]]
+}
+
+// reachable counts the cells a snake moving into start next turn can reach,
+// stopping once limit cells have been found. Unlike room it waits for bodies
+// to move: a cell counts if the snake can get there after it has been freed.
+func (analysis *BoardAnalysis) reachable(start rules.Point, limit int) int {
+	if !analysis.in_bounds(start) || !analysis.free(analysis.index(start)) {
+		return 0
+	}
+
+	type step struct {
+		cell int
+		turn int
+	}
+	seen := make([]bool, len(analysis.free_at))
+	seen[analysis.index(start)] = true
+	queue := []step{{analysis.index(start), 1}}
+	area := 0
+	for len(queue) > 0 && area < limit {
+		current := queue[0]
+		queue = queue[1:]
+		area += 1
+		for _, next := range analysis.neighbours(current.cell) {
+			if !seen[next] && analysis.free_at[next] <= current.turn+1 {
+				seen[next] = true
+				queue = append(queue, step{next, current.turn + 1})
+			}
+		}
+	}
+	return area
+}
+
+// space is the room a snake moving into p has, counting tails that move out
+// of its way when there is not enough room otherwise.
+func (analysis *BoardAnalysis) space(p rules.Point, length int) int {
+	room := analysis.room(p)
+	if room >= length {
+		return room
+	}
+	return max_int(room, analysis.reachable(p, length))
+}
+
+// prune_moves drops the moves into pockets too small for the snake, unless
+// every move is, in which case only the roomiest are kept.
+func prune_moves(sim *Simulation, snake_id string, moves []rules.SnakeMove) []rules.SnakeMove {
+	snake := get_snake(sim.board, snake_id)
+	if snake == nil || len(snake.Body) == 0 || len(moves) < 2 {
+		return moves
+	}
+
+	analysis := analyse_board(sim)
+	spaces := make([]int, len(moves))
+	best := 0
+	for i, move := range moves {
+		spaces[i] = analysis.space(sim.neighbour(snake.Body[0], move.Move), len(snake.Body))
+		best = max_int(best, spaces[i])
+	}
+
+	need := min_int(len(snake.Body), best)
+	kept := []rules.SnakeMove{}
+	for i, move := range moves {
+		if spaces[i] >= need {
+			kept = append(kept, move)
+		}
+	}
+	return kept
+}
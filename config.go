@@ -0,0 +1,296 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds every setting of the snake. It is loaded once at startup from,
+// in increasing priority, the defaults, the config file, the environment and
+// the command line. Every setting has the same name in all three, e.g.
+// iterations=500 in the file, iterations=500 in the environment and
+// -iterations 500 on the command line.
+type Config struct {
+	// iterations caps the search, zero searches until the time runs out.
+	iterations int
+	// time_budget caps the time spent on a move, zero only goes by the
+	// game's timeout.
+	time_budget time.Duration
+	workers     int
+	search_mode string
+	seed        int64
+	// max_nodes caps the nodes of the sequential tree, zero leaves it to
+	// grow as long as there is time.
+	max_nodes int
+
+	selection      string
+	exploration    float64
+	rollout_policy string
+	rollout_depth  int
+	evaluator      string
+	// engine is the simulation play outs run on, see FastBoard.
+	engine string
+
+	tie_reward      float64
+	survival_reward float64
+
+	avoid_lethal_hazards bool
+	log_level            string
+	// decision_log is a file every decision record is appended to, as well
+	// as being logged.
+	decision_log string
+}
+
+const (
+	DEFAULT_CONFIG_FILE = ".env"
+
+	LOG_DEBUG = "debug"
+	LOG_INFO  = "info"
+	LOG_WARN  = "warn"
+	LOG_ERROR = "error"
+)
+
+var log_levels = map[string]int{LOG_DEBUG: 0, LOG_INFO: 1, LOG_WARN: 2, LOG_ERROR: 3}
+
+// config is the configuration the server runs with. It holds the defaults
+// until main loads the real one.
+var config = default_config()
+
+func default_config() Config {
+	return Config{
+		workers:              1,
+		search_mode:          SEARCH_SEQUENTIAL,
+		selection:            SELECT_UCB1,
+		exploration:          DEFAULT_EXPLORATION,
+		rollout_policy:       ROLLOUT_RANDOM,
+		evaluator:            EVAL_HEURISTIC,
+		engine:               ENGINE_RULES,
+		avoid_lethal_hazards: true,
+		log_level:            LOG_INFO,
+	}
+}
+
+// config_setting reads one setting from its text form.
+type config_setting struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+var config_settings = []config_setting{
+	{"iterations", "simulations per move, 0 searches until the time runs out", func(c *Config, v string) error {
+		return parse_int(v, &c.iterations)
+	}},
+	{"time_budget", "milliseconds to search per move at most, 0 only goes by the game's timeout", func(c *Config, v string) error {
+		ms := 0
+		err := parse_int(v, &ms)
+		c.time_budget = time.Duration(ms) * time.Millisecond
+		return err
+	}},
+	{"workers", "goroutines searching in parallel", func(c *Config, v string) error {
+		return parse_int(v, &c.workers)
+	}},
+	{"search_mode", "sequential or simultaneous", func(c *Config, v string) error {
+		c.search_mode = v
+		return nil
+	}},
+	{"max_nodes", "nodes the sequential tree may hold, 0 for no limit", func(c *Config, v string) error {
+		return parse_int(v, &c.max_nodes)
+	}},
+	{"seed", "seed for every search, 0 picks a new one each move", func(c *Config, v string) error {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+		c.seed = seed
+		return nil
+	}},
+	{"selection", "ucb1, ucb1-tuned, puct or thompson", func(c *Config, v string) error {
+		c.selection = v
+		return nil
+	}},
+	{"exploration", "exploration constant of the selection policy", func(c *Config, v string) error {
+		return parse_float(v, &c.exploration)
+	}},
+	{"rollout_policy", "random, food or safe, optionally mixed with random moves as name:epsilon", func(c *Config, v string) error {
+		c.rollout_policy = v
+		return nil
+	}},
+	{"rollout_depth", "turns a play out runs before it is scored by the evaluator, 0 plays to the end", func(c *Config, v string) error {
+		return parse_int(v, &c.rollout_depth)
+	}},
+	{"evaluator", "heuristic or voronoi, scores play outs cut off by rollout_depth", func(c *Config, v string) error {
+		c.evaluator = v
+		return nil
+	}},
+	{"engine", "rules or fast, fast only plays random rollouts and falls back to rules in royale, constrictor and squad games", func(c *Config, v string) error {
+		c.engine = v
+		return nil
+	}},
+	{"tie_reward", "reward for snakes that are eliminated together last", func(c *Config, v string) error {
+		return parse_float(v, &c.tie_reward)
+	}},
+	{"survival_reward", "reward for surviving a whole play out before being eliminated", func(c *Config, v string) error {
+		return parse_float(v, &c.survival_reward)
+	}},
+	{"avoid_lethal_hazards", "never step into hazards that would kill us", func(c *Config, v string) error {
+		avoid, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		c.avoid_lethal_hazards = avoid
+		return nil
+	}},
+	{"log_level", "debug, info, warn or error", func(c *Config, v string) error {
+		c.log_level = v
+		return nil
+	}},
+	{"decision_log", "file to append a JSON record of every move decision to", func(c *Config, v string) error {
+		c.decision_log = v
+		return nil
+	}},
+}
+
+func parse_int(value string, into *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", value)
+	}
+	*into = parsed
+	return nil
+}
+
+func parse_float(value string, into *float64) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	*into = parsed
+	return nil
+}
+
+// set changes one setting by name, as written in the config file.
+func (config *Config) set(name string, value string) error {
+	for _, setting := range config_settings {
+		if setting.name == name {
+			return setting.set(config, value)
+		}
+	}
+	return fmt.Errorf("unknown setting %q", name)
+}
+
+// validate reports every setting that is out of range or names something that
+// doesn't exist.
+func (config Config) validate() error {
+	return config_error(config.problems())
+}
+
+func config_error(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+func (config Config) problems() []string {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(config.iterations >= 0, "iterations must not be negative, got %d", config.iterations)
+	check(config.time_budget >= 0, "time_budget must not be negative, got %v", config.time_budget)
+	check(config.workers >= 1, "workers must be at least 1, got %d", config.workers)
+	check(config.search_mode == SEARCH_SEQUENTIAL || config.search_mode == SEARCH_SIMULTANEOUS,
+		"search_mode must be %s or %s, got %q", SEARCH_SEQUENTIAL, SEARCH_SIMULTANEOUS, config.search_mode)
+	check(config.max_nodes == 0 || config.max_nodes >= MIN_NODE_BUDGET,
+		"max_nodes must be 0 or at least %d, got %d", MIN_NODE_BUDGET, config.max_nodes)
+	check(config.max_nodes == 0 || config.search_mode == SEARCH_SEQUENTIAL,
+		"max_nodes only bounds the %s tree, got search_mode %q", SEARCH_SEQUENTIAL, config.search_mode)
+	check(config.exploration >= 0, "exploration must not be negative, got %v", config.exploration)
+	check(config.rollout_depth >= 0, "rollout_depth must not be negative, got %d", config.rollout_depth)
+	check(config.tie_reward >= 0 && config.tie_reward <= 1, "tie_reward must be between 0 and 1, got %v", config.tie_reward)
+	check(config.survival_reward >= 0 && config.survival_reward <= 1, "survival_reward must be between 0 and 1, got %v", config.survival_reward)
+	check(config.engine == ENGINE_RULES || config.engine == ENGINE_FAST,
+		"engine must be %s or %s, got %q", ENGINE_RULES, ENGINE_FAST, config.engine)
+	check(config.engine != ENGINE_FAST || config.rollout_policy == ROLLOUT_RANDOM,
+		"the %s engine only plays %s rollouts, got rollout_policy %q", ENGINE_FAST, ROLLOUT_RANDOM, config.rollout_policy)
+	_, known_level := log_levels[config.log_level]
+	check(known_level, "log_level must be debug, info, warn or error, got %q", config.log_level)
+
+	if _, err := parse_selection_policy(config.selection, config.exploration, nil); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parse_rollout_policy(config.rollout_policy); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parse_evaluator(config.evaluator); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// load_config reads the configuration from the config file, the environment
+// and args, and returns it with the arguments left after the flags.
+func load_config(args []string) (Config, []string, error) {
+	config := default_config()
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	config_file := flags.String("config", DEFAULT_CONFIG_FILE, "file of name=value settings")
+	for _, setting := range config_settings {
+		flags.String(setting.name, "", setting.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, nil, err
+	}
+
+	file, err := godotenv.Read(*config_file)
+	if err != nil && (*config_file != DEFAULT_CONFIG_FILE || !os.IsNotExist(err)) {
+		return config, nil, fmt.Errorf("reading %s: %w", *config_file, err)
+	}
+
+	problems := []string{}
+	for _, setting := range config_settings {
+		if value, ok := file[setting.name]; ok {
+			if err := setting.set(&config, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s in %s: %s", setting.name, *config_file, err))
+			}
+		}
+		if value, ok := os.LookupEnv(setting.name); ok {
+			if err := setting.set(&config, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s in the environment: %s", setting.name, err))
+			}
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if err := config.set(f.Name, f.Value.String()); err != nil {
+			problems = append(problems, fmt.Sprintf("-%s: %s", f.Name, err))
+		}
+	})
+	problems = append(problems, config.problems()...)
+	return config, flags.Args(), config_error(problems)
+}
+
+// logf logs when level is at or above the configured log level.
+func logf(level string, format string, args ...interface{}) {
+	if logging(level) {
+		log.Printf(format, args...)
+	}
+}
+
+// logging is whether messages of level are logged.
+func logging(level string) bool {
+	return log_levels[level] >= log_levels[config.log_level]
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// The conformance tests play random games with the official rulesets and check
+// that every way we advance a board agrees with them after every turn: the
+// joint executeActions, a rotation of executeAction calls, one per snake, and
+// the FastBoard in the modes it plays. The FastBoard's valid moves are checked
+// against getValidMoves as well.
+//
+// Royale is left out since the official shrink regenerates hazards from the
+// game seed, which the simulation deliberately doesn't do, and squad has no
+// official ruleset left to compare against.
+
+var conformance_modes = []string{rules.GameTypeStandard, rules.GameTypeWrapped, rules.GameTypeConstrictor}
+
+func Test_ConformanceRandomBoards(t *testing.T) {
+
+	for _, mode := range conformance_modes {
+		for seed := int64(1); seed <= 40; seed++ {
+			rng := rand.New(rand.NewSource(seed))
+			board := random_board(rng, seed)
+			replay_conformance(t, fmt.Sprintf("%s seed %d", mode, seed), mode, board, rng)
+		}
+	}
+}
+
+func Test_ConformanceRecordedBoards(t *testing.T) {
+
+	for _, fixture := range []string{"test_request.json", "request.json", "survival_request.json"} {
+		state := fixture_state(t, fixture)
+
+		for seed := int64(1); seed <= 20; seed++ {
+			board := simulationFromGame(&state).board
+			rng := rand.New(rand.NewSource(seed))
+			replay_conformance(t, fmt.Sprintf("%s seed %d", fixture, seed), rules.GameTypeStandard, board, rng)
+		}
+	}
+}
+
+// replay_conformance plays up to 150 random turns from board, reporting every
+// divergence from the official ruleset.
+func replay_conformance(t *testing.T, name string, mode string, board rules.BoardState, rng *rand.Rand) {
+	t.Helper()
+
+	solo := len(board.Snakes) == 1
+	settings := rules.Settings{HazardDamagePerTurn: 14}
+	official := rules.NewRulesetBuilder().
+		WithParams(map[string]string{rules.ParamGameType: mode}).
+		WithSolo(solo).
+		Ruleset()
+	sim := Simulation{
+		board:     board,
+		settings:  settings,
+		rules_set: new_pipeline(mode, solo, nil),
+		ruleset:   mode,
+		solo:      solo,
+	}
+
+	for turn := 0; turn < 150 && !sim.is_game_over(); turn++ {
+		moves := random_moves(rng, &sim)
+
+		_, expected, err := official.Execute(&sim.board, settings, moves)
+		if err != nil {
+			t.Fatalf("%s turn %d: official ruleset failed: %s", name, turn, err)
+		}
+		// The engine advances the turn, the ruleset doesn't.
+		expected.Turn += 1
+
+		joint := sim.copy()
+		_, joint_board, err := joint.executeActions(moves)
+		if err != nil {
+			t.Fatalf("%s turn %d: executeActions failed: %s", name, turn, err)
+		}
+		for _, diff := range diff_boards(expected, joint_board) {
+			t.Errorf("%s turn %d executeActions: %s", name, turn, diff)
+		}
+
+		rotation := sim.copy()
+		for i, move := range moves {
+			_, rotated, err := rotation.executeAction(move, i == len(moves)-1)
+			if err != nil {
+				t.Fatalf("%s turn %d: executeAction failed: %s", name, turn, err)
+			}
+			rotation.board = *rotated
+		}
+		for _, diff := range diff_boards(expected, &rotation.board) {
+			t.Errorf("%s turn %d executeAction rotation: %s", name, turn, diff)
+		}
+
+		if fast_supported(&sim) {
+			check_fast_board(t, fmt.Sprintf("%s turn %d", name, turn), &sim, moves, expected)
+		}
+
+		if t.Failed() {
+			printMap(&sim.board)
+			return
+		}
+		sim.board = *expected
+	}
+}
+
+// check_fast_board plays moves on a FastBoard made from sim and compares the
+// result with the expected board.
+func check_fast_board(t *testing.T, name string, sim *Simulation, moves []rules.SnakeMove, expected *rules.BoardState) {
+	t.Helper()
+
+	fast := new_fast_board(sim)
+	for i, snake := range sim.board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		want := []string{}
+		for _, move := range sim.getValidMoves(snake.ID) {
+			want = append(want, move.Move)
+		}
+		got := []string{}
+		scratch := sim.copy()
+		for _, dir := range fast.snake_moves(&scratch, i, nil) {
+			got = append(got, fast_dirs[dir])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: FastBoard valid moves for %s are %v, expected %v", name, snake.ID, got, want)
+		}
+	}
+
+	dirs := make([]int, len(moves))
+	for i, move := range moves {
+		for dir, name := range fast_dirs {
+			if move.Move == name {
+				dirs[i] = dir
+			}
+		}
+	}
+	fast.execute(dirs)
+
+	actual := sim.copy()
+	fast.write(&actual.board)
+	for _, diff := range diff_boards(expected, &actual.board) {
+		t.Errorf("%s FastBoard: %s", name, diff)
+	}
+}
+
+// random_board places 1 to 4 snakes on a random sized board with food, and
+// some hazards, a few of them stacked.
+func random_board(rng *rand.Rand, seed int64) rules.BoardState {
+	width := 7 + rng.Intn(6)
+	height := 7 + rng.Intn(6)
+	ids := []string{}
+	for i := 0; i <= rng.Intn(4); i++ {
+		ids = append(ids, fmt.Sprintf("snake-%d", i))
+	}
+
+	board, err := rules.CreateDefaultBoardState(rules.NewSeedRand(seed), width, height, ids)
+	if err != nil {
+		panic(err.Error())
+	}
+	for i := range board.Snakes {
+		board.Snakes[i].Health = 5 + rng.Intn(96)
+	}
+	for i := 0; i < rng.Intn(width*height/4); i++ {
+		hazard := rules.Point{X: rng.Intn(width), Y: rng.Intn(height)}
+		board.Hazards = append(board.Hazards, hazard)
+		if rng.Intn(5) == 0 {
+			board.Hazards = append(board.Hazards, hazard)
+		}
+	}
+	board.Turn = 1
+	return *board
+}
+
+// random_moves gives every snake a move, usually one getValidMoves allows so
+// games last, but sometimes any direction so deaths are covered too.
+func random_moves(rng *rand.Rand, sim *Simulation) []rules.SnakeMove {
+	dirs := []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight}
+	moves := []rules.SnakeMove{}
+	for _, snake := range sim.board.Snakes {
+		move := rules.SnakeMove{ID: snake.ID, Move: dirs[rng.Intn(len(dirs))]}
+		if snake.EliminatedCause == rules.NotEliminated && rng.Intn(10) < 8 {
+			valid := sim.getValidMoves(snake.ID)
+			move = valid[rng.Intn(len(valid))]
+		}
+		moves = append(moves, move)
+	}
+	return moves
+}
+
+// diff_boards lists every difference in bodies, health, elimination, food and
+// hazards between the expected board and the actual one.
+func diff_boards(expected *rules.BoardState, actual *rules.BoardState) []string {
+	diffs := []string{}
+	if expected.Turn != actual.Turn {
+		diffs = append(diffs, fmt.Sprintf("turn is %d, expected %d", actual.Turn, expected.Turn))
+	}
+
+	for _, want := range expected.Snakes {
+		got := get_snake(*actual, want.ID)
+		if got == nil {
+			diffs = append(diffs, fmt.Sprintf("snake %s is missing", want.ID))
+			continue
+		}
+		if fmt.Sprint(got.Body) != fmt.Sprint(want.Body) {
+			diffs = append(diffs, fmt.Sprintf("snake %s body is %v, expected %v", want.ID, got.Body, want.Body))
+		}
+		if got.Health != want.Health {
+			diffs = append(diffs, fmt.Sprintf("snake %s health is %d, expected %d", want.ID, got.Health, want.Health))
+		}
+		if got.EliminatedCause != want.EliminatedCause || got.EliminatedBy != want.EliminatedBy {
+			diffs = append(diffs, fmt.Sprintf("snake %s eliminated by %q (%s), expected %q (%s)",
+				want.ID, got.EliminatedCause, got.EliminatedBy, want.EliminatedCause, want.EliminatedBy))
+		}
+	}
+	if len(actual.Snakes) != len(expected.Snakes) {
+		diffs = append(diffs, fmt.Sprintf("%d snakes, expected %d", len(actual.Snakes), len(expected.Snakes)))
+	}
+
+	if !same_points(expected.Food, actual.Food) {
+		diffs = append(diffs, fmt.Sprintf("food is %v, expected %v", actual.Food, expected.Food))
+	}
+	if !same_points(expected.Hazards, actual.Hazards) {
+		diffs = append(diffs, fmt.Sprintf("hazards are %v, expected %v", actual.Hazards, expected.Hazards))
+	}
+	return diffs
+}
+
+// same_points compares two lists of points ignoring order, but not repeats.
+func same_points(a []rules.Point, b []rules.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, p := range a {
+		if count_points(a, p) != count_points(b, p) {
+			return false
+		}
+	}
+	return true
+}
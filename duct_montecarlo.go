@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Battlesnake is a simultaneous move game, every snake moves at the same time
+// and the moves are resolved together. The sequential tree fakes that with a
+// rotation, which lets later snakes react to earlier ones. JointNode instead
+// uses decoupled UCT: at each node every snake picks its own move from its own
+// statistics, and the resulting joint move selects the child.
+
+const (
+	SEARCH_SEQUENTIAL   = "sequential"
+	SEARCH_SIMULTANEOUS = "simultaneous"
+)
+
+type JointNode struct {
+	parent   *JointNode
+	children map[string]*JointNode
+	board    Simulation
+	sims     int
+
+	// players are the snakes still alive on this board, arms[i] holds the
+	// statistics for each move players[i] can make.
+	players []string
+	arms    [][]Arm
+
+	// picked is the arm each of the parent's players chose to reach this node.
+	picked []int
+	// size is the number of nodes in the subtree, counting this one.
+	size int
+}
+
+type Arm struct {
+	move    rules.SnakeMove
+	sims    int
+	wins    float64
+	sq_wins float64
+	prior   float64
+}
+
+func (arm *Arm) stats() ArmStats {
+	return ArmStats{
+		sims:     arm.sims,
+		value:    arm.wins,
+		sq_value: arm.sq_wins,
+		prior:    arm.prior,
+	}
+}
+
+func new_joint_node(parent *JointNode, board Simulation, picked []int) *JointNode {
+	node := &JointNode{
+		parent:   parent,
+		children: map[string]*JointNode{},
+		board:    board,
+		picked:   picked,
+		size:     1,
+	}
+
+	if board.is_game_over() {
+		return node
+	}
+
+	for _, snake := range board.board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		arms := []Arm{}
+		moves := board.getValidMoves(snake.ID)
+		priors := move_priors(&board, snake.ID, moves)
+		for i, move := range moves {
+			arms = append(arms, Arm{move: move, prior: priors[i]})
+		}
+		node.players = append(node.players, snake.ID)
+		node.arms = append(node.arms, arms)
+	}
+	return node
+}
+
+func (node *JointNode) is_terminal() bool {
+	return len(node.players) == 0
+}
+
+func (tree *Tree) expand_joint_tree(rng *rand.Rand) (bool, error) {
+	node, err := tree.select_joint_leaf()
+	if err != nil {
+		return false, err
+	}
+
+	rewards, finished, err := node.play_out(tree.rollout_settings(rng))
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	if finished {
+		node.back_prop(rewards)
+	} else {
+		node.unvisit()
+	}
+	return finished, err
+}
+
+// select_joint_leaf is select_leaf for the simultaneous tree.
+func (tree *Tree) select_joint_leaf() (*JointNode, error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	node, depth := tree.joint_root, 0
+	for !node.is_terminal() {
+		depth += 1
+		picked := node.select_arms(tree.selection)
+		child, ok := node.children[joint_key(picked)]
+		if !ok {
+			var err error
+			if child, err = node.create_child(picked); err != nil {
+				return nil, err
+			}
+			node = child
+			break
+		}
+		node = child
+	}
+	tree.depth = max_int(tree.depth, depth)
+
+	node.visit()
+	return node, nil
+}
+
+// select_arms picks a move for every player independently, each by its own
+// statistics.
+func (node *JointNode) select_arms(policy SelectionPolicy) []int {
+	picked := make([]int, len(node.players))
+	for i, arms := range node.arms {
+		max_val := math.Inf(-1)
+		for j := range arms {
+			val := policy.score(arms[j].stats(), node.sims)
+			if val > max_val {
+				max_val = val
+				picked[i] = j
+			}
+		}
+	}
+	return picked
+}
+
+func (node *JointNode) joint_move(picked []int) []rules.SnakeMove {
+	moves := []rules.SnakeMove{}
+	for i, arm := range picked {
+		moves = append(moves, node.arms[i][arm].move)
+	}
+	return moves
+}
+
+func (node *JointNode) create_child(picked []int) (*JointNode, error) {
+	board_copy := node.board.copy()
+	_, new_board, err := board_copy.executeActions(node.joint_move(picked))
+	if err != nil {
+		return nil, fmt.Errorf("expanding: %w", err)
+	}
+	board_copy.board = *new_board
+
+	child := new_joint_node(node, board_copy, picked)
+	node.children[joint_key(picked)] = child
+	for above := node; above != nil; above = above.parent {
+		above.size += 1
+	}
+	return child, nil
+}
+
+func joint_key(picked []int) string {
+	var key strings.Builder
+	for _, arm := range picked {
+		key.WriteByte(byte('0' + arm))
+	}
+	return key.String()
+}
+
+func (node *JointNode) visit() {
+	node.sims += 1
+	if node.parent != nil {
+		for i, arm := range node.picked {
+			node.parent.arms[i][arm].sims += 1
+		}
+		node.parent.visit()
+	}
+}
+
+func (node *JointNode) unvisit() {
+	node.sims -= 1
+	if node.parent != nil {
+		for i, arm := range node.picked {
+			node.parent.arms[i][arm].sims -= 1
+		}
+		node.parent.unvisit()
+	}
+}
+
+func (node *JointNode) back_prop(rewards map[string]float64) {
+	if node.parent != nil {
+		for i, arm := range node.picked {
+			reward := rewards[node.parent.players[i]]
+			node.parent.arms[i][arm].wins += reward
+			node.parent.arms[i][arm].sq_wins += reward * reward
+		}
+		node.parent.back_prop(rewards)
+	}
+}
+
+// play_out plays simultaneous moves chosen by the rollout policy until the game
+// ends or reaches the depth cap, with the same deadline handling as the
+// sequential rollout.
+func (node *JointNode) play_out(settings RolloutSettings) (map[string]float64, bool, error) {
+	copy_board := node.board.copy()
+	copy_board.settings = copy_board.settings.WithRand(rules_rand{settings.rng})
+	record := new_rollout_record(&copy_board.board, copy_board.squads, settings.max_depth)
+
+	if settings.fast && fast_supported(&copy_board) {
+		rewards, finished := fast_play_out(&copy_board, record, settings, 0)
+		return rewards, finished, nil
+	}
+
+	for depth := 0; ; depth++ {
+		if copy_board.is_game_over() {
+			break
+		}
+
+		if time.Now().After(settings.deadline) {
+			return nil, false, nil
+		}
+
+		if settings.max_depth > 0 && depth >= settings.max_depth {
+			return record.cutoff_rewards(&copy_board, settings.evaluate, settings.rewards), true, nil
+		}
+
+		moves := []rules.SnakeMove{}
+		for _, snake := range copy_board.board.Snakes {
+			if snake.EliminatedCause != rules.NotEliminated {
+				continue
+			}
+			valid := copy_board.getValidMoves(snake.ID)
+			moves = append(moves, settings.policy.choose_move(settings.rng, &copy_board, snake.ID, valid))
+		}
+
+		_, new_board, err := copy_board.executeActions(moves)
+		if err != nil {
+			return nil, false, fmt.Errorf("playing out: %w", err)
+		}
+		copy_board.board = *new_board
+		record.advance(&copy_board.board)
+	}
+	return record.game_rewards(settings.rewards), true, nil
+}
+
+func (node *JointNode) select_best_move(snake_id string, name string) rules.SnakeMove {
+	for i, player := range node.players {
+		if player != snake_id {
+			continue
+		}
+
+		best_arm := node.arms[i][0]
+		for _, arm := range node.arms[i] {
+			if arm.sims > best_arm.sims {
+				best_arm = arm
+			}
+		}
+		logf(LOG_DEBUG, "%s selected best move %s on turn %d", name, best_arm.move.Move, node.board.board.Turn)
+		return best_arm.move
+	}
+	return rules.SnakeMove{ID: snake_id, Move: rules.MoveUp}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Rollouts that hit the depth cap before the game ends are scored by a
+// BoardEvaluator instead of a winner. The rewards it returns are each snake's
+// share of the win, so they are in [0, 1] and sum to at most 1, just like a
+// finished game's reward of 1 for the winner and 0 for everyone else.
+type BoardEvaluator func(sim *Simulation) map[string]float64
+
+const (
+	EVAL_HEURISTIC = "heuristic"
+
+	// Higher temperatures make the heuristic less sure of who is winning.
+	HEURISTIC_TEMPERATURE = 0.15
+)
+
+var evaluators = map[string]BoardEvaluator{
+	EVAL_HEURISTIC: heuristic_eval,
+	EVAL_VORONOI:   voronoi_eval,
+}
+
+// RolloutSettings is everything a play out needs from the tree.
+type RolloutSettings struct {
+	deadline time.Time
+	policy   RolloutPolicy
+	rng      *rand.Rand
+	// fast plays the play out on a FastBoard when the game mode allows it.
+	fast bool
+
+	// max_depth caps a play out at that many turns, zero plays until the end.
+	max_depth int
+	evaluate  BoardEvaluator
+	rewards   RewardSettings
+}
+
+// RewardSettings gives losing snakes some credit. When the last snakes die
+// together each of them gets tie, and any other snake that is eliminated earns
+// survival times the fraction of the play out it lived through.
+type RewardSettings struct {
+	tie      float64
+	survival float64
+}
+
+func parse_evaluator(name string) (BoardEvaluator, error) {
+	if name == "" {
+		return heuristic_eval, nil
+	}
+	evaluate, ok := evaluators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown board evaluator %q", name)
+	}
+	return evaluate, nil
+}
+
+// rollout_record tracks when snakes die during a play out, which the tie and
+// survival rewards need.
+type rollout_record struct {
+	turns         int
+	alive         []string
+	eliminated_at map[string]int
+	tied          []string
+	squads        map[string]string
+
+	// A solo game has no winner, its snake is scored by the share of horizon
+	// turns it lasted instead.
+	solo    bool
+	horizon int
+}
+
+// new_rollout_record starts the record of a play out capped at max_depth
+// turns. Without a cap a solo snake is measured against as many turns as it
+// can go without eating. squads maps snake IDs to their squad in squad games.
+func new_rollout_record(board *rules.BoardState, squads map[string]string, max_depth int) *rollout_record {
+	horizon := max_depth
+	if horizon == 0 {
+		horizon = rules.SnakeMaxHealth
+	}
+	return &rollout_record{
+		alive:         alive_snakes(board),
+		eliminated_at: map[string]int{},
+		squads:        squads,
+		solo:          len(board.Snakes) == 1,
+		horizon:       horizon,
+	}
+}
+
+// advance is called after every turn of the play out.
+func (record *rollout_record) advance(board *rules.BoardState) {
+	record.advance_alive(alive_snakes(board))
+}
+
+// advance_alive is advance with the snakes still alive after the step.
+func (record *rollout_record) advance_alive(alive []string) {
+	record.turns += 1
+	if len(alive) == len(record.alive) {
+		return
+	}
+
+	died := []string{}
+	for _, id := range record.alive {
+		if !contains_id(alive, id) {
+			record.eliminated_at[id] = record.turns
+			died = append(died, id)
+		}
+	}
+	if len(alive) == 0 {
+		record.tied = died
+	}
+	record.alive = append([]string{}, alive...)
+}
+
+// game_rewards scores a finished game: 1 for the winner, or for every snake
+// left of the winning squad, the tie reward for the snakes that went out
+// together, and survival credit for the rest.
+func (record *rollout_record) game_rewards(settings RewardSettings) map[string]float64 {
+	rewards := map[string]float64{}
+	if record.solo {
+		for id, turn := range record.eliminated_at {
+			rewards[id] = math.Min(1, float64(turn)/float64(record.horizon))
+		}
+		return rewards
+	}
+	if record.won() {
+		for _, id := range record.alive {
+			rewards[id] = 1
+		}
+	}
+	for _, id := range record.tied {
+		rewards[id] = settings.tie
+	}
+	record.add_survival(rewards, settings)
+	return rewards
+}
+
+// won is whether the snakes left won the game: there is only one of them, or
+// they are all on the same squad.
+func (record *rollout_record) won() bool {
+	if len(record.alive) == 0 {
+		return false
+	}
+	squad := record.squads[record.alive[0]]
+	for _, id := range record.alive[1:] {
+		if squad == "" || record.squads[id] != squad {
+			return false
+		}
+	}
+	return true
+}
+
+// cutoff_rewards scores a play out that hit the depth cap with the evaluator.
+func (record *rollout_record) cutoff_rewards(sim *Simulation, evaluate BoardEvaluator, settings RewardSettings) map[string]float64 {
+	rewards := evaluate(sim)
+	record.add_survival(rewards, settings)
+	return rewards
+}
+
+func (record *rollout_record) add_survival(rewards map[string]float64, settings RewardSettings) {
+	if settings.survival == 0 || record.turns == 0 {
+		return
+	}
+	for id, turn := range record.eliminated_at {
+		if contains_id(record.tied, id) {
+			continue
+		}
+		rewards[id] += settings.survival * float64(turn) / float64(record.turns)
+	}
+}
+
+func alive_snakes(board *rules.BoardState) []string {
+	alive := []string{}
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause == rules.NotEliminated {
+			alive = append(alive, snake.ID)
+		}
+	}
+	return alive
+}
+
+func contains_id(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// heuristic_eval scores every living snake on its length, health, the room it
+// has to move and how close it is to food, then turns the scores into win
+// shares with a softmax.
+func heuristic_eval(sim *Simulation) map[string]float64 {
+	board := &sim.board
+	cells := board.Width * board.Height
+	analysis := analyse_board(sim)
+	longest := 1
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause == rules.NotEliminated && len(snake.Body) > longest {
+			longest = len(snake.Body)
+		}
+	}
+
+	scores := map[string]float64{}
+	total := 0.0
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		head := snake.Body[0]
+
+		food_dist := board.Width + board.Height
+		for _, food := range board.Food {
+			dist := abs(food.X-head.X) + abs(food.Y-head.Y)
+			if dist < food_dist {
+				food_dist = dist
+			}
+		}
+
+		area := 0
+		for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+			if reach := analysis.room(sim.neighbour(head, dir)); reach > area {
+				area = reach
+			}
+		}
+
+		score := 0.4*float64(len(snake.Body))/float64(longest) +
+			0.2*float64(snake.Health)/rules.SnakeMaxHealth +
+			0.3*float64(area)/float64(cells) -
+			0.1*float64(food_dist)/float64(board.Width+board.Height)
+
+		scores[snake.ID] = math.Exp(score / HEURISTIC_TEMPERATURE)
+		total += scores[snake.ID]
+	}
+
+	for id := range scores {
+		scores[id] /= total
+	}
+	return scores
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func min_int(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max_int(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime/debug"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// A failed search must not cost us the game, or take the server down with it.
+// When the search returns an error, or anything panics while answering a move,
+// we still answer with the best move we can find without it.
+
+// fallback_move is the move to make when the tree's search failed: the most
+// visited of our moves if the search got that far, otherwise safe_move.
+func (tree *Tree) fallback_move(state GameState) string {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	best, best_sims := "", 0
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		for i, player := range tree.joint_root.players {
+			if player != tree.player {
+				continue
+			}
+			for _, arm := range tree.joint_root.arms[i] {
+				if arm.sims > best_sims {
+					best, best_sims = arm.move.Move, arm.sims
+				}
+			}
+		}
+	} else {
+		for _, child := range tree.root.children {
+			if child.sims > best_sims {
+				best, best_sims = child.action.Move, child.sims
+			}
+		}
+	}
+
+	if best == "" {
+		return safe_move(state)
+	}
+	return best
+}
+
+// safe_move picks the valid move that leaves us the most room. It only needs
+// the request, and never panics, so it is safe to call while recovering.
+func safe_move(state GameState) (move string) {
+	move = rules.MoveUp
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Failed to find a safe move, %v", r)
+		}
+	}()
+
+	sim := simulationFromGame(&state)
+	snake := get_snake(sim.board, state.You.ID)
+	if snake == nil || len(snake.Body) == 0 {
+		return move
+	}
+
+	analysis := analyse_board(&sim)
+	best_area := -1
+	for _, valid := range sim.getValidMoves(state.You.ID) {
+		area := analysis.space(sim.neighbour(snake.Body[0], valid.Move), len(snake.Body))
+		if area > best_area {
+			move, best_area = valid.Move, area
+		}
+	}
+	return move
+}
+
+// answer_move is move, answering with safe_move if anything panics.
+func answer_move(state GameState, seed int64) (response BattlesnakeMoveResponse) {
+	defer recover_move(state, &response)
+	return move(state, seed)
+}
+
+// recover_move turns a panic while answering a move into safe_move, logging
+// what went wrong. It must be deferred directly.
+func recover_move(state GameState, response *BattlesnakeMoveResponse) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := fmt.Errorf("%v", r)
+	log.Printf("ERROR: %s panicked on turn %d, %s\n%s", state.Game.ID, state.Turn, err, debug.Stack())
+	drop_tree(state.Game.ID)
+	response.Move = safe_move(state)
+}
+
+// doomed_move picks a move for a snake that has no valid move left. Every move
+// probably kills it, so it takes the one most likely not to: a cell a bigger
+// snake may not move into, or one where an equal snake that comes along dies
+// too. Walls and bodies are certain death and come last. Ties go to the move
+// with more room behind it.
+func (game *Simulation) doomed_move(snake *rules.Snake) rules.SnakeMove {
+	board := &game.board
+	in_bounds := func(p rules.Point) bool {
+		return p.X >= 0 && p.X < board.Width && p.Y >= 0 && p.Y < board.Height
+	}
+
+	// Bodies stay where they are, except for tails that move up this turn.
+	// A stacked tail has just eaten and stays put.
+	blocked := map[rules.Point]bool{}
+	for _, other := range board.Snakes {
+		if other.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		for i, body := range other.Body {
+			last := len(other.Body) - 1
+			if i == last && i > 0 && other.Body[i-1] != body {
+				continue
+			}
+			blocked[body] = true
+		}
+	}
+	escapes := func(other rules.Snake) int {
+		count := 0
+		for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+			cell := game.neighbour(other.Body[0], dir)
+			if in_bounds(cell) && !blocked[cell] {
+				count += 1
+			}
+		}
+		return max_int(count, 1)
+	}
+
+	analysis := analyse_board(game)
+	cells := board.Width * board.Height
+	best := rules.SnakeMove{ID: snake.ID, Move: rules.MoveUp}
+	best_score := math.Inf(-1)
+	for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+		cell := game.neighbour(snake.Body[0], dir)
+		score := -1.0
+		if in_bounds(cell) && !blocked[cell] {
+			survive, take_down := 1.0, 0.0
+			for _, other := range board.Snakes {
+				if other.ID == snake.ID || other.EliminatedCause != rules.NotEliminated || len(other.Body) == 0 {
+					continue
+				}
+				if len(other.Body) < len(snake.Body) || !game.adjacent(other.Body[0], cell) {
+					continue
+				}
+				chance := 1 / float64(escapes(other))
+				survive *= 1 - chance
+				if len(other.Body) == len(snake.Body) {
+					take_down += chance
+				}
+			}
+
+			damage := 1 + game.settings.HazardDamagePerTurn*count_points(board.Hazards, cell)
+			if !contains_point(board.Food, cell) && snake.Health <= damage {
+				survive = 0
+			}
+			room := float64(analysis.room(cell)) / float64(cells)
+			score = 2*survive + math.Min(take_down, 1) + 0.1*room
+		}
+
+		if score > best_score {
+			best_score = score
+			best = rules.SnakeMove{ID: snake.ID, Move: dir}
+		}
+	}
+	return best
+}
+
+// adjacent tells whether a and b are next to each other, going around the
+// edges on wrapped boards.
+func (game *Simulation) adjacent(a rules.Point, b rules.Point) bool {
+	for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+		if game.neighbour(a, dir) == b {
+			return true
+		}
+	}
+	return false
+}
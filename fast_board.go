@@ -0,0 +1,516 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Play outs through the rules package clone the board every step and walk the
+// snakes' bodies to find collisions. FastBoard is a compact copy of a
+// Simulation for play outs instead: an occupancy grid with a wall around it,
+// so stepping off the board is just another cell, and snake bodies in ring
+// buffers, so a move is a write at each end. It plays the standard, solo and
+// wrapped rules, the modes whose rules don't need anything but the board.
+
+const (
+	ENGINE_RULES = "rules"
+	ENGINE_FAST  = "fast"
+)
+
+type FastBoard struct {
+	width   int
+	height  int
+	stride  int
+	wrapped bool
+	solo    bool
+	turn    int
+
+	hazard_damage        int
+	avoid_lethal_hazards bool
+
+	// occupied counts the segments of living snakes on every cell, food and
+	// hazards mark the cells holding them, hazards once per copy. Cells are
+	// numbered with a one cell wall around the board, see cell.
+	occupied []uint8
+	food     []bool
+	hazards  []uint8
+	walls    []bool
+
+	snakes []FastSnake
+	// alive holds the IDs of the snakes still in the game, in board order.
+	alive []string
+}
+
+// FastSnake keeps its body in a ring buffer, head first from body[head].
+type FastSnake struct {
+	id     string
+	body   []int
+	head   int
+	length int
+	health int
+
+	eliminated    string
+	eliminated_by string
+}
+
+// fast_supported tells whether sim's game mode can be played on a FastBoard.
+func fast_supported(sim *Simulation) bool {
+	switch sim.ruleset {
+	case rules.GameTypeRoyale, rules.GameTypeConstrictor, GAME_TYPE_SQUAD:
+		return false
+	}
+	return true
+}
+
+func new_fast_board(sim *Simulation) *FastBoard {
+	board := &sim.board
+	stride := board.Width + 2
+	cells := stride * (board.Height + 2)
+	fast := &FastBoard{
+		width:         board.Width,
+		height:        board.Height,
+		stride:        stride,
+		wrapped:       sim.ruleset == rules.GameTypeWrapped,
+		solo:          sim.solo,
+		turn:          board.Turn,
+		hazard_damage: sim.settings.HazardDamagePerTurn,
+		occupied:      make([]uint8, cells),
+		food:          make([]bool, cells),
+		hazards:       make([]uint8, cells),
+		walls:         make([]bool, cells),
+		snakes:        make([]FastSnake, len(board.Snakes)),
+
+		avoid_lethal_hazards: sim.avoid_lethal_hazards,
+	}
+
+	for cell := range fast.walls {
+		x, y := cell%stride-1, cell/stride-1
+		fast.walls[cell] = x < 0 || x >= board.Width || y < 0 || y >= board.Height
+	}
+	for _, food := range board.Food {
+		fast.food[fast.cell(food)] = true
+	}
+	for _, hazard := range board.Hazards {
+		fast.hazards[fast.cell(hazard)] += 1
+	}
+
+	for i, snake := range board.Snakes {
+		body := make([]int, len(snake.Body), max_int(2*len(snake.Body), 4))
+		for j, point := range snake.Body {
+			body[j] = fast.cell(point)
+		}
+		fast.snakes[i] = FastSnake{
+			id:            snake.ID,
+			body:          body[:cap(body)],
+			length:        len(snake.Body),
+			health:        snake.Health,
+			eliminated:    snake.EliminatedCause,
+			eliminated_by: snake.EliminatedBy,
+		}
+		if snake.EliminatedCause == rules.NotEliminated {
+			for _, cell := range body {
+				fast.occupied[cell] += 1
+			}
+		}
+	}
+	fast.update_alive()
+	return fast
+}
+
+// cell numbers a point on the board, or on the wall around it.
+func (fast *FastBoard) cell(p rules.Point) int {
+	return (p.Y+1)*fast.stride + p.X + 1
+}
+
+func (fast *FastBoard) point(cell int) rules.Point {
+	return rules.Point{X: cell%fast.stride - 1, Y: cell/fast.stride - 1}
+}
+
+func (fast *FastBoard) on_board(cell int) bool {
+	return !fast.walls[cell]
+}
+
+// step is the cell next to cell in direction dir, an index into fast_dirs.
+func (fast *FastBoard) step(cell int, dir int) int {
+	if !fast.wrapped {
+		return cell + [4]int{fast.stride, -fast.stride, -1, 1}[dir]
+	}
+	p := fast.point(cell)
+	p = move_point(p, fast_dirs[dir])
+	p.X = (p.X + fast.width) % fast.width
+	p.Y = (p.Y + fast.height) % fast.height
+	return fast.cell(p)
+}
+
+var fast_dirs = [4]string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight}
+
+func (snake *FastSnake) at(i int) int {
+	i += snake.head
+	if i >= len(snake.body) {
+		i -= len(snake.body)
+	}
+	return snake.body[i]
+}
+
+func (snake *FastSnake) tail() int {
+	return snake.at(snake.length - 1)
+}
+
+// stacked tells whether the tail stays where it is next move.
+func (snake *FastSnake) stacked() bool {
+	return snake.length > 1 && snake.at(snake.length-2) == snake.tail()
+}
+
+func (snake *FastSnake) push_head(cell int) {
+	snake.head = (snake.head - 1 + len(snake.body)) % len(snake.body)
+	snake.body[snake.head] = cell
+}
+
+func (snake *FastSnake) grow() {
+	if snake.length == len(snake.body) {
+		body := make([]int, 2*len(snake.body))
+		for i := 0; i < snake.length; i++ {
+			body[i] = snake.at(i)
+		}
+		snake.body, snake.head = body, 0
+	}
+	tail := snake.tail()
+	snake.length += 1
+	snake.body[(snake.head+snake.length-1)%len(snake.body)] = tail
+}
+
+func (fast *FastBoard) update_alive() {
+	fast.alive = fast.alive[:0]
+	for i := range fast.snakes {
+		if fast.snakes[i].eliminated == rules.NotEliminated {
+			fast.alive = append(fast.alive, fast.snakes[i].id)
+		}
+	}
+}
+
+func (fast *FastBoard) is_game_over() bool {
+	if fast.solo {
+		return len(fast.alive) == 0
+	}
+	return len(fast.alive) <= 1
+}
+
+// eliminate takes a snake out of the game and off the occupancy grid.
+func (fast *FastBoard) eliminate(snake *FastSnake, cause string, by string) {
+	snake.eliminated, snake.eliminated_by = cause, by
+	for i := 0; i < snake.length; i++ {
+		fast.occupied[snake.at(i)] -= 1
+	}
+}
+
+// execute plays one turn with dirs[i] the move of snake i, which is ignored
+// for eliminated snakes. It follows the stages of the standard pipeline and
+// returns whether the game was already over, like Simulation.executeActions.
+func (fast *FastBoard) execute(dirs []int) bool {
+	if fast.is_game_over() {
+		return true
+	}
+
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		if snake.eliminated != rules.NotEliminated {
+			continue
+		}
+		fast.occupied[snake.tail()] -= 1
+		snake.push_head(fast.step(snake.at(0), dirs[i]))
+		fast.occupied[snake.at(0)] += 1
+		snake.health -= 1
+	}
+
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		head := snake.at(0)
+		if snake.eliminated != rules.NotEliminated || fast.hazards[head] == 0 || fast.food[head] {
+			continue
+		}
+		snake.health -= fast.hazard_damage * int(fast.hazards[head])
+		snake.health = min_int(max_int(snake.health, 0), rules.SnakeMaxHealth)
+		if snake.health <= 0 {
+			fast.eliminate(snake, rules.EliminatedByOutOfHealth, "")
+		}
+	}
+
+	// Every snake on the food eats it before it is gone.
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		if snake.eliminated != rules.NotEliminated || !fast.food[snake.at(0)] {
+			continue
+		}
+		snake.grow()
+		fast.occupied[snake.tail()] += 1
+		snake.health = rules.SnakeMaxHealth
+	}
+	for i := range fast.snakes {
+		if fast.snakes[i].eliminated == rules.NotEliminated {
+			fast.food[fast.snakes[i].at(0)] = false
+		}
+	}
+
+	fast.eliminate_snakes()
+	fast.update_alive()
+	fast.turn += 1
+	return false
+}
+
+// eliminate_snakes is rules.EliminateSnakesStandard. The occupancy grid finds
+// the heads that ran into a body straight away, only those have the bodies
+// around them searched to find out whose body it was.
+func (fast *FastBoard) eliminate_snakes() {
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		if snake.eliminated != rules.NotEliminated {
+			continue
+		}
+		if snake.health <= 0 {
+			fast.eliminate(snake, rules.EliminatedByOutOfHealth, "")
+		} else if !fast.on_board(snake.at(0)) {
+			fast.eliminate(snake, rules.EliminatedByOutOfBounds, "")
+		}
+	}
+
+	heads := func(cell int) int {
+		count := 0
+		for i := range fast.snakes {
+			if fast.snakes[i].eliminated == rules.NotEliminated && fast.snakes[i].at(0) == cell {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	type elimination struct {
+		snake *FastSnake
+		cause string
+		by    string
+	}
+	eliminations := []elimination{}
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		if snake.eliminated != rules.NotEliminated {
+			continue
+		}
+		head := snake.at(0)
+		heads_here := heads(head)
+
+		if int(fast.occupied[head]) > heads_here {
+			if snake.has_segment(head) {
+				eliminations = append(eliminations, elimination{snake, rules.EliminatedBySelfCollision, snake.id})
+				continue
+			}
+			collided := false
+			for _, j := range fast.by_length() {
+				other := &fast.snakes[j]
+				if other != snake && other.eliminated == rules.NotEliminated && other.has_segment(head) {
+					eliminations = append(eliminations, elimination{snake, rules.EliminatedByCollision, other.id})
+					collided = true
+					break
+				}
+			}
+			if collided {
+				continue
+			}
+		}
+
+		if heads_here > 1 {
+			for _, j := range fast.by_length() {
+				other := &fast.snakes[j]
+				if other != snake && other.eliminated == rules.NotEliminated && other.at(0) == head && snake.length <= other.length {
+					eliminations = append(eliminations, elimination{snake, rules.EliminatedByHeadToHeadCollision, other.id})
+					break
+				}
+			}
+		}
+	}
+
+	for _, e := range eliminations {
+		fast.eliminate(e.snake, e.cause, e.by)
+	}
+}
+
+// by_length orders the snakes longest first. Eliminations are attributed to the
+// first snake in this order, and it is sorted just like the rules sort it.
+func (fast *FastBoard) by_length() []int {
+	order := make([]int, len(fast.snakes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i int, j int) bool {
+		return fast.snakes[order[i]].length > fast.snakes[order[j]].length
+	})
+	return order
+}
+
+// has_segment tells whether the snake's body, not counting its head, covers cell.
+func (snake *FastSnake) has_segment(cell int) bool {
+	for i := 1; i < snake.length; i++ {
+		if snake.at(i) == cell {
+			return true
+		}
+	}
+	return false
+}
+
+// valid_moves puts the moves getValidMoves would allow snake i into moves and
+// returns it, as indexes into fast_dirs. Unlike getValidMoves it comes back
+// empty when there is no valid move, rather than finding the least bad one,
+// see snake_moves.
+func (fast *FastBoard) valid_moves(i int, moves []int) []int {
+	snake := &fast.snakes[i]
+	var safe, risky, survivable [4]int
+	safe_count, risky_count := 0, 0
+
+	for dir := range fast_dirs {
+		cell := fast.step(snake.at(0), dir)
+		if !fast.on_board(cell) {
+			continue
+		}
+
+		bodies := int(fast.occupied[cell])
+		lost, is_safe := false, true
+		for j := range fast.snakes {
+			other := &fast.snakes[j]
+			if other.eliminated != rules.NotEliminated {
+				continue
+			}
+			if other.tail() == cell && !other.stacked() {
+				bodies -= 1
+			}
+			if j == i {
+				continue
+			}
+			if other.at(0) == cell {
+				bodies -= 1
+				lost = lost || snake.length <= other.length
+			} else if other.length >= snake.length && fast.adjacent(other.at(0), cell) {
+				is_safe = false
+			}
+		}
+		if bodies > 0 || lost {
+			continue
+		}
+
+		if is_safe {
+			safe[safe_count] = dir
+			safe_count += 1
+		} else {
+			risky[risky_count] = dir
+			risky_count += 1
+		}
+	}
+
+	valid := safe[:safe_count]
+	if safe_count == 0 {
+		valid = risky[:risky_count]
+	}
+
+	if fast.avoid_lethal_hazards {
+		survivable_count := 0
+		for _, dir := range valid {
+			cell := fast.step(snake.at(0), dir)
+			damage := 1 + fast.hazard_damage*int(fast.hazards[cell])
+			if fast.food[cell] || snake.health > damage {
+				survivable[survivable_count] = dir
+				survivable_count += 1
+			}
+		}
+		if survivable_count > 0 {
+			valid = survivable[:survivable_count]
+		}
+	}
+
+	return append(moves[:0], valid...)
+}
+
+// snake_moves is valid_moves with the least bad move when there is no valid
+// one, the same moves getValidMoves gives. That is rare enough to write the
+// game back to sim, which the FastBoard was made from, and leave the choice to
+// doomed_move.
+func (fast *FastBoard) snake_moves(sim *Simulation, i int, moves []int) []int {
+	moves = fast.valid_moves(i, moves)
+	if len(moves) > 0 {
+		return moves
+	}
+	fast.write(&sim.board)
+	doomed := sim.doomed_move(&sim.board.Snakes[i])
+	for dir, name := range fast_dirs {
+		if name == doomed.Move {
+			return append(moves, dir)
+		}
+	}
+	return append(moves, 0)
+}
+
+func (fast *FastBoard) adjacent(a int, b int) bool {
+	for dir := range fast_dirs {
+		if fast.step(a, dir) == b {
+			return true
+		}
+	}
+	return false
+}
+
+// write copies the state of the game back into board, which must be the
+// board the FastBoard was made from.
+func (fast *FastBoard) write(board *rules.BoardState) {
+	board.Turn = fast.turn
+	board.Food = board.Food[:0]
+	for y := 0; y < fast.height; y++ {
+		for x := 0; x < fast.width; x++ {
+			if p := (rules.Point{X: x, Y: y}); fast.food[fast.cell(p)] {
+				board.Food = append(board.Food, p)
+			}
+		}
+	}
+
+	for i := range fast.snakes {
+		snake := &fast.snakes[i]
+		out := &board.Snakes[i]
+		out.Body = out.Body[:0]
+		for j := 0; j < snake.length; j++ {
+			out.Body = append(out.Body, fast.point(snake.at(j)))
+		}
+		out.Health = snake.health
+		out.EliminatedCause = snake.eliminated
+		out.EliminatedBy = snake.eliminated_by
+	}
+}
+
+// fast_play_out finishes a play out on a FastBoard, with every snake moving
+// randomly between its valid moves. depth is the number of turns played so far
+// and sim is left holding the final board.
+func fast_play_out(sim *Simulation, record *rollout_record, settings RolloutSettings, depth int) (map[string]float64, bool) {
+	fast := new_fast_board(sim)
+	dirs := make([]int, len(fast.snakes))
+	moves := make([]int, 0, len(fast_dirs))
+
+	for ; !fast.is_game_over(); depth++ {
+		// Turns are quick enough that the clock is only read now and then.
+		if depth%8 == 0 && time.Now().After(settings.deadline) {
+			return nil, false
+		}
+
+		if settings.max_depth > 0 && depth >= settings.max_depth {
+			fast.write(&sim.board)
+			return record.cutoff_rewards(sim, settings.evaluate, settings.rewards), true
+		}
+
+		for i := range fast.snakes {
+			if fast.snakes[i].eliminated != rules.NotEliminated {
+				continue
+			}
+			moves = fast.snake_moves(sim, i, moves)
+			dirs[i] = moves[settings.rng.Intn(len(moves))]
+		}
+		fast.execute(dirs)
+		record.advance_alive(fast.alive)
+	}
+	fast.write(&sim.board)
+	return record.game_rewards(settings.rewards), true
+}
@@ -14,7 +14,20 @@ type Direction string
 type Simulation struct {
 	board     rules.BoardState
 	settings  rules.Settings
-	rules_set rules.StandardRuleset
+	rules_set rules.Pipeline
+
+	// ruleset is the game mode being played, solo is set when there is only
+	// one snake, and squads maps snake IDs to their squad in squad games.
+	ruleset string
+	solo    bool
+	squads  map[string]string
+
+	// avoid_lethal_hazards drops moves into hazards that would kill the
+	// snake from getValidMoves, unless there is nothing else.
+	avoid_lethal_hazards bool
+	// priors is set when the search selects with PUCT, the only policy
+	// that reads the move priors of an expansion.
+	priors bool
 }
 
 func (sim *Simulation) copy() Simulation {
@@ -22,6 +35,12 @@ func (sim *Simulation) copy() Simulation {
 		board:     *sim.board.Clone(),
 		settings:  sim.settings,
 		rules_set: sim.rules_set,
+		ruleset:   sim.ruleset,
+		solo:      sim.solo,
+		squads:    sim.squads,
+
+		avoid_lethal_hazards: sim.avoid_lethal_hazards,
+		priors:               sim.priors,
 	}
 }
 
@@ -72,6 +91,14 @@ func printMap(boardState *rules.BoardState) {
 	log.Print(o.String())
 }
 func simulationFromGame(game *GameState) Simulation {
+	squads := map[string]string{}
+	for _, snake := range game.Board.Snakes {
+		if snake.Squad != "" {
+			squads[snake.ID] = snake.Squad
+		}
+	}
+	solo := len(game.Board.Snakes) == 1
+
 	return Simulation{
 		board: rules.BoardState{
 			Turn:   game.Turn,
@@ -79,9 +106,14 @@ func simulationFromGame(game *GameState) Simulation {
 			Width:  game.Board.Width,
 			Snakes: convertSnakes(game.Board.Snakes),
 			Food:   convert_food(game.Board.Food),
+			// Hazards can be listed more than once, each copy does damage.
+			Hazards: convert_food(game.Board.Hazards),
 		},
-		rules_set: convert_ruleset(game.Game.Ruleset),
+		rules_set: convert_ruleset(game.Game.Ruleset, solo, squads),
 		settings:  convert_settings(game.Game.Ruleset.Settings),
+		ruleset:   game.Game.Ruleset.Name,
+		solo:      solo,
+		squads:    squads,
 	}
 }
 
@@ -108,13 +140,8 @@ func convert_settings(settings Settings) rules.Settings {
 	}
 }
 
-func convert_ruleset(ruleset Ruleset) rules.StandardRuleset {
-
-	return rules.StandardRuleset{
-		FoodSpawnChance:     int(ruleset.Settings.FoodSpawnChance),
-		MinimumFood:         int(ruleset.Settings.MinimumFood),
-		HazardDamagePerTurn: int(ruleset.Settings.HazardDamagePerTurn),
-	}
+func convert_ruleset(ruleset Ruleset, solo bool, squads map[string]string) rules.Pipeline {
+	return new_pipeline(ruleset.Name, solo, squads)
 }
 
 func (sim *Simulation) generateMoveMatrix() [][]rules.SnakeMove {
@@ -249,62 +276,38 @@ func snakeIsOutOfBounds(s *rules.Snake, boardWidth int, boardHeight int) bool {
 	return false
 }
 
-func (game *Simulation) find_food_moves(snakeId string) rules.SnakeMove {
+// find_food_moves picks the move from moves that brings the snake's head
+// closest to any food. With no food on the board it returns the first move.
+func (game *Simulation) find_food_moves(snakeId string, moves []rules.SnakeMove) rules.SnakeMove {
 
 	closest := math.MaxInt
-	closest_move := rules.MoveUp
-
-	no_move := true
+	closest_move := moves[0]
 
 	snake := get_snake(game.board, snakeId)
 
-	var dirs = []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight}
-
-	for _, dir := range dirs {
-
-		println(dir)
-
-		snake_moved := move_point(copy_point(snake.Body[0]), dir)
-
-		if snake_moved.X >= game.board.Width || snake_moved.X < 0 || snake_moved.Y >= game.board.Height || snake_moved.Y < 0 {
-			continue
-		}
-
-		valid := true
+	for _, move := range moves {
 
-		for _, bod := range snake.Body {
-			if snake_moved.X == bod.X && snake_moved.Y == bod.Y {
-				valid = false
-				break
-			}
-		}
+		snake_moved := move_point(snake.Body[0], move.Move)
 
-		if valid {
-			if no_move {
-				closest_move = dir
-				no_move = false
-			}
+		for _, food := range game.board.Food {
+			xd := food.X - snake_moved.X
+			yd := food.Y - snake_moved.Y
 
-			for _, food := range game.board.Food {
-				xd := food.X - snake_moved.X
-				yd := food.Y - snake_moved.Y
-
-				println(xd*xd+yd*yd, dir)
-
-				if xd*xd+yd*yd < closest {
-					closest = xd*xd + yd*yd
-					closest_move = dir
-					println("closest", dir, food.X, food.Y)
-				}
+			if xd*xd+yd*yd < closest {
+				closest = xd*xd + yd*yd
+				closest_move = move
 			}
 		}
-
 	}
 
-	return rules.SnakeMove{ID: snakeId, Move: closest_move}
-
+	return closest_move
 }
 
+// getValidMoves returns the moves of snakeId that don't lose it the game on
+// the spot: into a wall, into a body that will still be there, or into the
+// head of a snake at least as long. Moves next to the head of such a snake
+// risk a head to head and are only kept when there is nothing safer. With no
+// valid move left the snake gets the least bad of the fatal ones.
 func (game *Simulation) getValidMoves(snakeId string) []rules.SnakeMove {
 
 	snake := get_snake(game.board, snakeId)
@@ -312,54 +315,98 @@ func (game *Simulation) getValidMoves(snakeId string) []rules.SnakeMove {
 	var dirs = []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight}
 
 	var valid_moves = []rules.SnakeMove{}
+	var risky_moves = []rules.SnakeMove{}
 
-	if snake.EliminatedCause != "" {
-
+	if snake == nil || snake.EliminatedCause != rules.NotEliminated || len(snake.Body) == 0 {
 		return valid_moves
 	}
 
 	for _, dir := range dirs {
 
-		snake_moved := move_point(snake.Body[0], dir)
+		snake_moved := game.neighbour(snake.Body[0], dir)
 
 		// Checks for wall collisions.
 		if snake_moved.X >= game.board.Width || snake_moved.X < 0 || snake_moved.Y >= game.board.Height || snake_moved.Y < 0 {
 			continue
 		}
 
-		valid := true
-		for _, other := range game.board.Snakes {
-			if snake_self_collided(snake_moved, &other) {
+		valid, safe := true, true
+		for i := range game.board.Snakes {
+			other := &game.board.Snakes[i]
+			if other.EliminatedCause != rules.NotEliminated || len(other.Body) == 0 {
+				continue
+			}
+
+			if snake_self_collided(snake_moved, other) {
 				valid = false
 				break
 			}
 
-			if snake.ID == snakeId {
+			if other.ID == snakeId {
 				continue
 			}
 
-			if snakeHasLostHeadToHead(&snake_moved, &other, len(snake.Body)) {
+			if snakeHasLostHeadToHead(&snake_moved, other, len(snake.Body)) {
 				valid = false
 				break
 			}
+
+			if len(other.Body) >= len(snake.Body) && game.adjacent(other.Body[0], snake_moved) {
+				safe = false
+			}
 		}
 
-		if valid {
-			valid_moves = append(valid_moves, rules.SnakeMove{
-				ID:   snakeId,
-				Move: dir,
-			})
+		move := rules.SnakeMove{ID: snakeId, Move: dir}
+		if valid && safe {
+			valid_moves = append(valid_moves, move)
+		} else if valid {
+			risky_moves = append(risky_moves, move)
 		}
 
 	}
 
 	if len(valid_moves) == 0 {
-		valid_moves = append(valid_moves, rules.SnakeMove{Move: rules.MoveUp, ID: snakeId})
+		valid_moves = risky_moves
+	}
+
+	if game.avoid_lethal_hazards {
+		valid_moves = game.drop_lethal_hazards(snake, valid_moves)
+	}
+
+	if len(valid_moves) == 0 {
+		valid_moves = append(valid_moves, game.doomed_move(snake))
 	}
 
 	return valid_moves
 }
 
+// drop_lethal_hazards removes the moves into hazards the snake doesn't have
+// the health to survive. If every move is lethal they are all kept.
+func (game *Simulation) drop_lethal_hazards(snake *rules.Snake, moves []rules.SnakeMove) []rules.SnakeMove {
+	survivable := []rules.SnakeMove{}
+	for _, move := range moves {
+		cell := game.neighbour(snake.Body[0], move.Move)
+		damage := 1 + game.settings.HazardDamagePerTurn*count_points(game.board.Hazards, cell)
+		if contains_point(game.board.Food, cell) || snake.Health > damage {
+			survivable = append(survivable, move)
+		}
+	}
+	if len(survivable) == 0 {
+		return moves
+	}
+	return survivable
+}
+
+func count_points(points []rules.Point, point rules.Point) int {
+	count := 0
+	for _, p := range points {
+		if p == point {
+			count += 1
+		}
+	}
+	return count
+}
+
 func getMoveFromDir(dir []int) string {
 	if dir[0] == 1 {
 		return rules.MoveRight
@@ -383,12 +430,16 @@ func snakeHasLostHeadToHead(head *rules.Point, other *rules.Snake, head_len int)
 	return false
 }
 
+// snake_self_collided tells whether head runs into the body of other. Its head
+// is left to the head to head check, and its tail moves out of the way unless
+// it is stacked, when the snake has just eaten.
 func snake_self_collided(head rules.Point, other *rules.Snake) bool {
+	last := len(other.Body) - 1
 	for i, body := range other.Body {
 		if i == 0 {
 			continue
 		}
-		if i == len(other.Body)-1 {
+		if i == last && other.Body[i-1] != body {
 			continue
 		}
 		if head.X == body.X && head.Y == body.Y {
@@ -398,6 +449,27 @@ func snake_self_collided(head rules.Point, other *rules.Snake) bool {
 	return false
 }
 
+// neighbour is the cell next to point in direction dir. On wrapped boards it
+// comes back around the other side instead of leaving the board.
+func (game *Simulation) neighbour(point rules.Point, dir string) rules.Point {
+	next := move_point(point, dir)
+	if game.ruleset == rules.GameTypeWrapped {
+		next.X = (next.X + game.board.Width) % game.board.Width
+		next.Y = (next.Y + game.board.Height) % game.board.Height
+	}
+	return next
+}
+
+func wrap_head(b *rules.BoardState, snake_id string) {
+	for i := range b.Snakes {
+		snake := &b.Snakes[i]
+		if snake.ID == snake_id && snake.EliminatedCause == rules.NotEliminated {
+			snake.Body[0].X = (snake.Body[0].X + b.Width) % b.Width
+			snake.Body[0].Y = (snake.Body[0].Y + b.Height) % b.Height
+		}
+	}
+}
+
 func get_snake(board rules.BoardState, snakeId string) *rules.Snake {
 	for _, snake := range board.Snakes {
 		if snake.ID == snakeId {
@@ -417,38 +489,64 @@ func (game *Simulation) executeActions(moves []rules.SnakeMove) (bool, *rules.Bo
 			})
 		}
 	}
-	return game.rules_set.Execute(&game.board, game.settings, moves)
+	game_over, board, err := game.rules_set.Execute(&game.board, game.settings, moves)
+	if err == nil && !game_over {
+		board.Turn += 1
+	}
+	return game_over, board, err
 }
 
 func (game *Simulation) executeAction(move rules.SnakeMove, last_in_rotation bool) (bool, *rules.BoardState, error) {
 	move_arr := []rules.SnakeMove{move}
 
-	game_over, err := rules.GameOverStandard(&game.board, game.settings, move_arr)
+	game_over := game.is_game_over()
 
 	if game_over {
-		return game_over, &game.board, err
+		return game_over, &game.board, nil
 	}
 
-	_, err1 := MoveSnakesStandard(&game.board, game.settings, move_arr)
-	if err1 != nil {
-		panic(err1.Error())
+	if _, err := MoveSnakesStandard(&game.board, game.settings, move_arr); err != nil {
+		return false, &game.board, fmt.Errorf("moving %s %s: %w", move.ID, move.Move, err)
 	}
-
-	_, err2 := rules.ReduceSnakeHealthStandard(&game.board, game.settings, move_arr)
-	if err2 != nil {
-		panic(err2.Error())
+	if game.ruleset == rules.GameTypeWrapped {
+		wrap_head(&game.board, move.ID)
 	}
 
-	if last_in_rotation {
-		_, err3 := rules.FeedSnakesStandard(&game.board, game.settings, move_arr)
-		if err3 != nil {
-			panic(err3.Error())
+	// Only the snake that moved pays for it, otherwise every snake would
+	// starve once per player in the rotation.
+	for i := range game.board.Snakes {
+		snake := &game.board.Snakes[i]
+		if snake.ID == move.ID && snake.EliminatedCause == rules.NotEliminated {
+			snake.Health -= 1
 		}
 	}
 
-	_, err4 := rules.EliminateSnakesStandard(&game.board, game.settings, move_arr)
-	if err4 != nil {
-		panic(err4.Error())
+	// Everything else waits until the whole rotation has moved, so a snake
+	// can't collide with where another snake was before it moved. That makes
+	// a full rotation come out the same as the official ruleset.
+	if !last_in_rotation {
+		return game_over, &game.board, nil
+	}
+
+	if _, err := rules.DamageHazardsStandard(&game.board, game.settings, move_arr); err != nil {
+		return false, &game.board, fmt.Errorf("damaging snakes in hazards: %w", err)
+	}
+
+	if _, err := rules.FeedSnakesStandard(&game.board, game.settings, move_arr); err != nil {
+		return false, &game.board, fmt.Errorf("feeding snakes: %w", err)
+	}
+
+	if _, err := rules.EliminateSnakesStandard(&game.board, game.settings, move_arr); err != nil {
+		return false, &game.board, fmt.Errorf("eliminating snakes: %w", err)
+	}
+
+	if game.ruleset == GAME_TYPE_SQUAD {
+		squad_collisions(&game.board, game.settings, game.squads)
+		squad_elimination(&game.board, game.settings, game.squads)
+	}
+
+	if err := game.end_turn(); err != nil {
+		return false, &game.board, fmt.Errorf("ending turn %d: %w", game.board.Turn, err)
 	}
 
 	return game_over, &game.board, nil
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"log"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
 )
 
 func info() BattlesnakeInfoResponse {
-	log.Println("INFO")
+	logf(LOG_INFO, "INFO")
 	return BattlesnakeInfoResponse{
 		APIVersion: "1",
 		Author:     "",
@@ -16,18 +18,38 @@ func info() BattlesnakeInfoResponse {
 }
 
 func start(state GameState) {
-	log.Printf("%s START\n", state.Game.ID)
+	logf(LOG_INFO, "%s START\n", state.Game.ID)
+	evict_idle_games(time.Now().Add(-IDLE_GAME_TIMEOUT))
+	cache_tree(state.Game.ID, new_tree(state, config))
 }
 
 func end(state GameState) {
-	log.Printf("%s END\n\n", state.Game.ID)
+	logf(LOG_INFO, "%s END\n\n", state.Game.ID)
+	forget_search_time(state.Game.ID)
+	drop_tree(state.Game.ID)
 }
 
-func move(state GameState) BattlesnakeMoveResponse {
+// move searches for the best move. seed is the seed the request asked for, zero
+// leaves the choice to search_seed.
+func move(state GameState, seed int64) BattlesnakeMoveResponse {
+
+	started := time.Now()
+	tree := game_tree(state)
+	tree.deadline = started.Add(move_budget(state))
+	tree.reseed(search_seed(seed))
+	best_move, err := tree.monte_move()
+	if err != nil {
+		logf(LOG_ERROR, "ERROR: %s search failed on turn %d, %s", state.Game.ID, state.Turn, err)
+		drop_tree(state.Game.ID)
+		best_move = rules.SnakeMove{ID: state.You.ID, Move: tree.fallback_move(state)}
+	}
+	log_decision(state, tree.decision_record(state, best_move.Move, time.Since(started)))
 
-	tree := new_tree(state)
+	elapsed := time.Since(started)
+	record_search_time(state.Game.ID, elapsed)
+	record_move_metrics(state, elapsed, tree.iterations)
 
 	return BattlesnakeMoveResponse{
-		Move: tree.monte_move().Move,
+		Move: best_move.Move,
 	}
 }
@@ -1,5 +1,21 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 func main() {
+	loaded, args, err := load_config(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config = loaded
+
+	if len(args) > 0 && args[0] == "selfplay" {
+		selfplay(args[1:])
+		return
+	}
 	start_server()
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// /metrics serves counters and histograms in the Prometheus text format, so
+// the snake can be watched in production without scraping its logs. The
+// format is simple enough that it is written out by hand here rather than
+// pulling in the client library.
+
+type Counter struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+// add increases the counter for the given label value, "" if it has no labels.
+func (counter *Counter) add(label string, delta float64) {
+	counter.Lock()
+	if counter.values == nil {
+		counter.values = map[string]float64{}
+	}
+	counter.values[label] += delta
+	counter.Unlock()
+}
+
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []int
+	sum     float64
+	count   int
+}
+
+func new_histogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]int, len(buckets))}
+}
+
+func (histogram *Histogram) observe(value float64) {
+	histogram.Lock()
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i] += 1
+		}
+	}
+	histogram.sum += value
+	histogram.count += 1
+	histogram.Unlock()
+}
+
+var metrics = struct {
+	move_latency     *Histogram
+	move_iterations  *Histogram
+	rollouts_per_sec *Histogram
+	rollouts         *Counter
+	decode_errors    *Counter
+	timeouts         *Counter
+}{
+	move_latency:     new_histogram(0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.75, 1, 2.5),
+	move_iterations:  new_histogram(10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000),
+	rollouts_per_sec: new_histogram(100, 500, 1000, 5000, 10000, 50000, 100000, 500000),
+	rollouts:         &Counter{},
+	decode_errors:    &Counter{},
+	timeouts:         &Counter{},
+}
+
+// record_move_metrics is called after every move with the time it took and the
+// simulations it completed. Moves that took longer than the game allows are
+// counted as timeouts, the engine will have moved us forward already.
+func record_move_metrics(state GameState, elapsed time.Duration, iterations int) {
+	metrics.move_latency.observe(elapsed.Seconds())
+	metrics.move_iterations.observe(float64(iterations))
+	metrics.rollouts.add("", float64(iterations))
+	if elapsed > 0 {
+		metrics.rollouts_per_sec.observe(float64(iterations) / elapsed.Seconds())
+	}
+
+	timeout := time.Duration(state.Game.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT_MS * time.Millisecond
+	}
+	if elapsed > timeout {
+		metrics.timeouts.add("", 1)
+	}
+}
+
+func games_active() int {
+	game_trees.Lock()
+	defer game_trees.Unlock()
+	return len(game_trees.trees)
+}
+
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	write_metrics(w)
+}
+
+func write_metrics(w io.Writer) {
+	write_histogram(w, "snake_move_latency_seconds", "Time taken to answer a move request.", metrics.move_latency)
+	write_histogram(w, "snake_move_iterations", "Simulations completed per move.", metrics.move_iterations)
+	write_histogram(w, "snake_rollouts_per_second", "Simulations per second of search, per move.", metrics.rollouts_per_sec)
+	write_counter(w, "snake_rollouts_total", "Simulations completed.", "", metrics.rollouts)
+	write_counter(w, "snake_decode_errors_total", "Requests whose body could not be decoded.", "endpoint", metrics.decode_errors)
+	write_counter(w, "snake_move_timeouts_total", "Moves answered after the game's timeout.", "", metrics.timeouts)
+
+	fmt.Fprintf(w, "# HELP snake_games_active Games with a search tree in memory.\n")
+	fmt.Fprintf(w, "# TYPE snake_games_active gauge\n")
+	fmt.Fprintf(w, "snake_games_active %d\n", games_active())
+}
+
+func write_counter(w io.Writer, name string, help string, label string, counter *Counter) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	counter.Lock()
+	defer counter.Unlock()
+	if label == "" {
+		fmt.Fprintf(w, "%s %v\n", name, counter.values[""])
+		return
+	}
+	values := []string{}
+	for value := range counter.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", name, label, value, counter.values[value])
+	}
+}
+
+func write_histogram(w io.Writer, name string, help string, histogram *Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	histogram.Lock()
+	defer histogram.Unlock()
+	for i, bound := range histogram.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, fmt.Sprint(bound), histogram.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, histogram.count)
+	fmt.Fprintf(w, "%s_sum %v\n", name, histogram.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, histogram.count)
+}
@@ -2,26 +2,958 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
 )
 
+// fixture_state reads a move request bundled with the repo.
+func fixture_state(tb testing.TB, fixture string) GameState {
+	body, err := os.ReadFile(fixture)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	state := GameState{}
+	if err := json.Unmarshal(body, &state); err != nil {
+		tb.Fatal(err)
+	}
+	return state
+}
+
 func Test_MonteCarlo(t *testing.T) {
 
-	test_body, err := os.ReadFile("test_request.json")
+	state := fixture_state(t, "test_request.json")
+
+	move(state, 0)
+}
+
+func Test_TreeReuse(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	start(state)
+	defer end(state)
+
+	tree := game_tree(state)
+	tree.deadline = time.Now().Add(100 * time.Millisecond)
+	our_move, err := tree.monte_move()
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err)
 	}
 
-	state := GameState{}
+	// Play the turn out on the root board: our move, then the opponent's.
+	node := tree.root.find_child(our_move.Move)
+	node = node.children[0]
+	board, err := node.simulation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := state
+	next.Turn += 1
+	next.Board.Food = convert_coords(board.board.Food)
+	next.Board.Snakes = []Battlesnake{}
+	for _, snake := range board.board.Snakes {
+		next.Board.Snakes = append(next.Board.Snakes, Battlesnake{
+			ID:     snake.ID,
+			Health: int32(snake.Health),
+			Body:   convert_coords(snake.Body),
+		})
+	}
+
+	if reused := game_tree(next); reused != tree || reused.root != node {
+		t.Fatal("expected the searched subtree to be promoted to the root")
+	}
+	if node.parent != nil {
+		t.Fatal("expected the promoted root to be detached from its parent")
+	}
+}
+
+func Test_IdleGames(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+	start(state)
+	defer end(state)
+	record_search_time(state.Game.ID, time.Millisecond)
+
+	// The other game was last heard from long ago.
+	cache_tree("abandoned", new_tree(state, config))
+	record_search_time("abandoned", time.Millisecond)
+	game_trees.used["abandoned"] = time.Now().Add(-time.Hour)
+	search_times.recorded["abandoned"] = time.Now().Add(-time.Hour)
+
+	evict_idle_games(time.Now().Add(-IDLE_GAME_TIMEOUT))
+	if cached_tree("abandoned") != nil || search_times.last["abandoned"] != 0 {
+		t.Fatal("expected the game that was never ended to be dropped")
+	}
+	if cached_tree(state.Game.ID) == nil || search_times.last[state.Game.ID] == 0 {
+		t.Fatal("expected the game in progress to be kept")
+	}
+}
+
+func Test_ParallelSearch(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	tree := new_tree(state, config)
+	tree.workers = 4
+	tree.deadline = time.Now().Add(time.Minute)
+	if err := tree.root.expandNode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.search(400); err != nil {
+		t.Fatal(err)
+	}
+
+	child_sims := 0
+	for _, child := range tree.root.children {
+		child_sims += child.sims
+	}
+	if tree.root.sims != 400 || child_sims != 400 {
+		t.Fatalf("expected 400 simulations, root has %d and its children %d", tree.root.sims, child_sims)
+	}
+}
+
+func Test_SeededSearch(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	search := func() *Tree {
+		tree := new_tree(state, config)
+		tree.workers = 1
+		tree.rollout = EpsilonGreedyRollout{epsilon: 0.5, greedy: SafeRollout{}}
+		tree.selection = Thompson{rng: tree.rng}
+		tree.deadline = time.Now().Add(time.Minute)
+		tree.reseed(7)
+		if err := tree.root.expandNode(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.search(300); err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+
+	first, second := search(), search()
+	for i, child := range first.root.children {
+		other := second.root.children[i]
+		if child.action != other.action || child.sims != other.sims || child.value() != other.value() {
+			t.Fatalf("expected the same statistics from the same seed, got %s %d %v and %s %d %v",
+				child.action.Move, child.sims, child.value(), other.action.Move, other.sims, other.value())
+		}
+	}
+	if first.root.select_best_move(state.You.ID, "") != second.root.select_best_move(state.You.ID, "") {
+		t.Fatal("expected the same move from the same seed")
+	}
+}
+
+func Test_NodeBudget(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	// count returns the nodes in the subtree and how many of them keep a board
+	// that isn't a finished game.
+	var count func(node *Node) (int, int)
+	count = func(node *Node) (int, int) {
+		nodes, boards := 1, 0
+		if node.board != nil && !node.board.is_game_over() {
+			boards = 1
+		}
+		for _, child := range node.children {
+			child_nodes, child_boards := count(child)
+			nodes += child_nodes
+			boards += child_boards
+		}
+		return nodes, boards
+	}
+
+	settings := config
+	settings.max_nodes = 200
+	tree := new_tree(state, settings)
+	tree.workers = 2
+	tree.deadline = time.Now().Add(time.Minute)
+	if err := tree.root.expandNode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.search(2000); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := tree.root.pool
+	nodes, boards := count(tree.root)
+	if pool.live > settings.max_nodes || pool.live != nodes {
+		t.Fatalf("expected at most %d nodes, the pool counts %d and the tree has %d", settings.max_nodes, pool.live, nodes)
+	}
+	if boards != 1 {
+		t.Fatalf("expected only the root to keep a board, %d nodes do", boards)
+	}
+	if tree.root.sims != 2000 {
+		t.Fatalf("expected the search to go on once the budget is used up, got %d simulations", tree.root.sims)
+	}
+
+	tree.trim_tree()
+	if nodes, _ := count(tree.root); pool.live > settings.max_nodes/2 || pool.live != nodes {
+		t.Fatalf("expected the tree trimmed to %d nodes, the pool counts %d and the tree has %d", settings.max_nodes/2, pool.live, nodes)
+	}
+	released := len(pool.free)
+	if err := tree.search(500); err != nil {
+		t.Fatal(err)
+	}
+	if released == 0 || len(pool.free) >= released {
+		t.Fatalf("expected the trimmed nodes to be reused, %d were released and %d are left", released, len(pool.free))
+	}
+}
+
+func Test_SimultaneousSearch(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	tree := new_tree(state, config)
+	tree.mode = SEARCH_SIMULTANEOUS
+	tree.joint_root = new_joint_node(nil, simulationFromGame(&state), nil)
+	tree.workers = 2
+	tree.deadline = time.Now().Add(time.Minute)
+	if err := tree.search(300); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, arms := range tree.joint_root.arms {
+		arm_sims := 0
+		for _, arm := range arms {
+			arm_sims += arm.sims
+		}
+		if arm_sims != 300 {
+			t.Fatalf("expected 300 simulations for %s, got %d", tree.joint_root.players[i], arm_sims)
+		}
+	}
+
+	best := tree.joint_root.select_best_move(state.You.ID, state.You.Name)
+	if best.ID != state.You.ID {
+		t.Fatalf("expected a move for %s, got one for %s", state.You.ID, best.ID)
+	}
+
+	// The decision record takes the tree's size from the nodes as they're
+	// added, check it against the tree itself.
+	var count func(node *JointNode) int
+	count = func(node *JointNode) int {
+		nodes := 1
+		for _, child := range node.children {
+			if child.size != count(child) {
+				t.Fatalf("expected a subtree of %d nodes, counted %d", child.size, count(child))
+			}
+			nodes += child.size
+		}
+		return nodes
+	}
+	if nodes := count(tree.joint_root); nodes != tree.joint_root.size || tree.depth < 1 {
+		t.Fatalf("expected a tree of %d nodes and some depth, counted %d at depth %d", tree.joint_root.size, nodes, tree.depth)
+	}
+}
+
+func Test_DepthLimitedRollout(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	for _, engine := range []string{ENGINE_RULES, ENGINE_FAST} {
+		tree := new_tree(state, config)
+		tree.config.engine = engine
+		tree.deadline = time.Now().Add(time.Minute)
+		tree.rollout_depth = 1
+		tree.evaluator = heuristic_eval
+		tree.root.expandNode()
+
+		node := tree.root.children[0]
+		board, err := node.simulation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewards, finished, err := node.play_out(board, tree.rollout_settings(rand.New(rand.NewSource(1))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !finished {
+			t.Fatalf("%s: expected the rollout to finish before the deadline", engine)
+		}
+
+		total := 0.0
+		for _, reward := range rewards {
+			if reward <= 0 || reward >= 1 {
+				t.Fatalf("%s: expected fractional rewards from the evaluator, got %v", engine, rewards)
+			}
+			total += reward
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Fatalf("%s: expected the rewards to sum to 1, got %v", engine, total)
+		}
+	}
+}
+
+func Test_RolloutRewards(t *testing.T) {
+
+	board := rules.BoardState{Snakes: []rules.Snake{{ID: "a"}, {ID: "b"}, {ID: "c"}}}
+	settings := RewardSettings{tie: 0.5, survival: 0.2}
+	record := new_rollout_record(&board, nil, 0)
+
+	record.advance(&board)
+	board.Snakes[2].EliminatedCause = rules.EliminatedByOutOfHealth
+	record.advance(&board)
+	board.Snakes[0].EliminatedCause = rules.EliminatedByHeadToHeadCollision
+	board.Snakes[1].EliminatedCause = rules.EliminatedByHeadToHeadCollision
+	record.advance(&board)
+	record.advance(&board)
+
+	rewards := record.game_rewards(settings)
+	if rewards["a"] != 0.5 || rewards["b"] != 0.5 {
+		t.Fatalf("expected the head to head to be a tie, got %v", rewards)
+	}
+	if math.Abs(rewards["c"]-0.2*2/4) > 1e-9 {
+		t.Fatalf("expected c to get credit for surviving 2 of 4 turns, got %v", rewards["c"])
+	}
+
+	// The game is over once a squad is left, every snake on it wins.
+	squads := map[string]string{"a": "red", "b": "red", "c": "blue"}
+	board = rules.BoardState{Snakes: []rules.Snake{{ID: "a"}, {ID: "b"}, {ID: "c"}}}
+	record = new_rollout_record(&board, squads, 0)
+	board.Snakes[2].EliminatedCause = rules.EliminatedByCollision
+	record.advance(&board)
+	rewards = record.game_rewards(settings)
+	if rewards["a"] != 1 || rewards["b"] != 1 || rewards["c"] != 0.2 {
+		t.Fatalf("expected the red squad to win, got %v", rewards)
+	}
+
+	// A solo snake always dies last, it is scored by how long it lasted.
+	solo := func(lived int, max_depth int) float64 {
+		board := rules.BoardState{Snakes: []rules.Snake{{ID: "a"}}}
+		record := new_rollout_record(&board, nil, max_depth)
+		for turn := 1; turn < lived; turn++ {
+			record.advance(&board)
+		}
+		board.Snakes[0].EliminatedCause = rules.EliminatedByOutOfHealth
+		record.advance(&board)
+		return record.game_rewards(settings)["a"]
+	}
+	if got := solo(10, 0); math.Abs(got-10.0/rules.SnakeMaxHealth) > 1e-9 {
+		t.Fatalf("expected a solo snake to be scored on 10 turns of a full health's worth, got %v", got)
+	}
+	if got := solo(10, 20); math.Abs(got-0.5) > 1e-9 {
+		t.Fatalf("expected a solo snake to be scored on 10 of 20 turns, got %v", got)
+	}
+	if solo(30, 0) <= solo(10, 0) {
+		t.Fatal("expected a solo snake that lasts longer to score higher")
+	}
+}
+
+func Test_SelectionPolicies(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+
+	visited := ArmStats{sims: 10, value: 9, sq_value: 9, prior: 0.5}
+	unvisited := ArmStats{prior: 0.5}
+
+	for _, name := range []string{SELECT_UCB1, SELECT_UCB1_TUNED, SELECT_PUCT} {
+		policy, err := parse_selection_policy(name, DEFAULT_EXPLORATION, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The exploration term must grow with the parent's visits.
+		if policy.score(visited, 100) <= policy.score(visited, 20) {
+			t.Errorf("%s: expected more exploration with more parent visits", name)
+		}
+	}
+
+	for _, name := range []string{SELECT_UCB1, SELECT_UCB1_TUNED} {
+		policy, _ := parse_selection_policy(name, DEFAULT_EXPLORATION, rng)
+		if policy.score(unvisited, 10) <= policy.score(visited, 10) {
+			t.Errorf("%s: expected unvisited moves to be tried first", name)
+		}
+	}
+
+	puct, _ := parse_selection_policy(SELECT_PUCT, DEFAULT_EXPLORATION, rng)
+	if puct.score(ArmStats{prior: 0.8}, 10) <= puct.score(ArmStats{prior: 0.2}, 10) {
+		t.Error("puct: expected the move with the higher prior to be preferred")
+	}
+
+	thompson, _ := parse_selection_policy(SELECT_THOMPSON, DEFAULT_EXPLORATION, rng)
+	for i := 0; i < 100; i++ {
+		if sample := thompson.score(visited, 10); sample < 0 || sample > 1 {
+			t.Fatalf("thompson: expected a sampled win rate, got %v", sample)
+		}
+	}
+
+	if _, err := parse_selection_policy("greedy", DEFAULT_EXPLORATION, rng); err == nil {
+		t.Error("expected an unknown selection policy to be rejected")
+	}
+}
+
+func Test_Rulesets(t *testing.T) {
+
+	for _, name := range []string{rules.GameTypeStandard, rules.GameTypeRoyale, rules.GameTypeConstrictor, rules.GameTypeWrapped, GAME_TYPE_SQUAD} {
+		for _, mode := range []string{SEARCH_SEQUENTIAL, SEARCH_SIMULTANEOUS} {
+			state := fixture_state(t, "test_request.json")
+			state.Game.Ruleset.Name = name
+			state.Game.Ruleset.Settings.Royale.ShrinkEveryNTurns = 5
+			state.Game.Ruleset.Settings.Squad.AllowBodyCollisions = true
+			for i := range state.Board.Snakes {
+				state.Board.Snakes[i].Squad = fmt.Sprint(i)
+			}
+
+			tree := new_tree(state, config)
+			tree.configure()
+			tree.deadline = time.Now().Add(time.Minute)
+			if mode == SEARCH_SIMULTANEOUS {
+				tree.mode = mode
+				tree.joint_root = new_joint_node(nil, simulationFromGame(&state), nil)
+			} else if err := tree.root.expandNode(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.search(50); err != nil {
+				t.Fatalf("%s %s: %s", name, mode, err)
+			}
+			if tree.iterations != 50 {
+				t.Errorf("%s %s: expected 50 simulations, got %d", name, mode, tree.iterations)
+			}
+		}
+	}
+}
+
+func Test_RoyaleShrink(t *testing.T) {
+
+	// The left column is hazardous already, the safe area is x 1 to 4.
+	board := rules.BoardState{Width: 5, Height: 5, Turn: 4}
+	for y := 0; y < 5; y++ {
+		board.Hazards = append(board.Hazards, rules.Point{X: 0, Y: y})
+	}
+	sides := map[string]bool{}
+	for seed := int64(1); seed <= 20; seed++ {
+		shrunk := *board.Clone()
+		settings := rules.Settings{RoyaleSettings: rules.RoyaleSettings{ShrinkEveryNTurns: 5}}.WithRand(rules.NewSeedRand(seed))
+		if _, err := shrink_royale(&shrunk, settings, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		added := shrunk.Hazards[len(board.Hazards):]
+		side := ""
+		switch {
+		case len(added) == 5 && all_points(added, func(p rules.Point) bool { return p.X == 1 }):
+			side = "left"
+		case len(added) == 5 && all_points(added, func(p rules.Point) bool { return p.X == 4 }):
+			side = "right"
+		case len(added) == 4 && all_points(added, func(p rules.Point) bool { return p.Y == 0 && p.X > 0 }):
+			side = "bottom"
+		case len(added) == 4 && all_points(added, func(p rules.Point) bool { return p.Y == 4 && p.X > 0 }):
+			side = "top"
+		default:
+			t.Fatalf("seed %d: expected one side of the safe area to turn hazardous, got %v", seed, added)
+		}
+		sides[side] = true
+	}
+	if len(sides) != 4 {
+		t.Errorf("expected every side to be picked at some point, got %v", sides)
+	}
+
+	board.Turn = 5
+	settings := rules.Settings{RoyaleSettings: rules.RoyaleSettings{ShrinkEveryNTurns: 5}}.WithRand(rules.NewSeedRand(1))
+	if _, err := shrink_royale(&board, settings, nil); err != nil || len(board.Hazards) != 5 {
+		t.Errorf("expected no shrinking between the shrink turns, got %d hazards", len(board.Hazards))
+	}
+}
+
+func all_points(points []rules.Point, ok func(rules.Point) bool) bool {
+	for _, p := range points {
+		if !ok(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_ReplayedShrink(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+	state.Game.Ruleset.Name = rules.GameTypeRoyale
+	state.Game.Ruleset.Settings.Royale.ShrinkEveryNTurns = 1
+
+	settings := config
+	settings.iterations = 100
+	tree := new_tree(state, settings)
+	tree.deadline = time.Now().Add(time.Minute)
+	tree.reseed(7)
+	if _, err := tree.monte_move(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both snakes have moved, so the board shrank at the end of the rotation.
+	node := tree.root.children[0].children[0]
+	first, err := node.simulation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.board.Hazards) == len(state.Board.Hazards) {
+		t.Fatal("expected the board to shrink after a rotation")
+	}
+	for i := 0; i < 20; i++ {
+		again, err := node.simulation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again.board.Hazards, first.board.Hazards) {
+			t.Fatalf("expected a replayed board to shrink the same way, got %v and %v", first.board.Hazards, again.board.Hazards)
+		}
+	}
+}
+
+func Test_SquadStages(t *testing.T) {
+
+	squads := map[string]string{"a": "1", "b": "1", "c": "2"}
+	board := func() rules.BoardState {
+		return rules.BoardState{Width: 7, Height: 7, Snakes: []rules.Snake{
+			{ID: "a", Health: 50, Body: body("1,1 1,2 1,3")},
+			{ID: "b", Health: 90, Body: body("3,1 3,2 3,3 3,4 3,5")},
+			{ID: "c", Health: 70, Body: body("5,1 5,2 5,3 5,4")},
+		}}
+	}
+	settings := rules.Settings{SquadSettings: rules.SquadSettings{
+		AllowBodyCollisions: true,
+		SharedElimination:   true,
+		SharedHealth:        true,
+		SharedLength:        true,
+	}}
+
+	// Running into a squadmate is undone, running into anyone else isn't.
+	collided := board()
+	collided.Snakes[0].EliminatedCause, collided.Snakes[0].EliminatedBy = rules.EliminatedByCollision, "b"
+	collided.Snakes[2].EliminatedCause, collided.Snakes[2].EliminatedBy = rules.EliminatedByCollision, "a"
+	squad_collisions(&collided, settings, squads)
+	if collided.Snakes[0].EliminatedCause != rules.NotEliminated || collided.Snakes[0].EliminatedBy != "" {
+		t.Errorf("expected a to be brought back after running into b, got %q by %q", collided.Snakes[0].EliminatedCause, collided.Snakes[0].EliminatedBy)
+	}
+	if collided.Snakes[2].EliminatedCause != rules.EliminatedByCollision {
+		t.Errorf("expected c to stay eliminated after running into another squad, got %q", collided.Snakes[2].EliminatedCause)
+	}
+
+	// A squad goes down together.
+	eliminated := board()
+	eliminated.Snakes[0].EliminatedCause, eliminated.Snakes[0].EliminatedBy = rules.EliminatedByHeadToHeadCollision, "c"
+	squad_elimination(&eliminated, settings, squads)
+	if b := eliminated.Snakes[1]; b.EliminatedCause != ELIMINATED_BY_SQUAD || b.EliminatedBy != "a" {
+		t.Errorf("expected b to go down with a, got %q by %q", b.EliminatedCause, b.EliminatedBy)
+	}
+	if eliminated.Snakes[2].EliminatedCause != rules.NotEliminated {
+		t.Errorf("expected c to be left alone, got %q", eliminated.Snakes[2].EliminatedCause)
+	}
+
+	// Squadmates share the best health and length of the squad.
+	shared := board()
+	squad_share(&shared, settings, squads)
+	for _, snake := range shared.Snakes[:2] {
+		if snake.Health != 90 || len(snake.Body) != 5 {
+			t.Errorf("expected %s to have health 90 and length 5, got %d and %d", snake.ID, snake.Health, len(snake.Body))
+		}
+	}
+	if c := shared.Snakes[2]; c.Health != 70 || len(c.Body) != 4 {
+		t.Errorf("expected c to keep its own health and length, got %d and %d", c.Health, len(c.Body))
+	}
+
+	// Without the settings the stages leave the board alone.
+	untouched := board()
+	untouched.Snakes[0].EliminatedCause, untouched.Snakes[0].EliminatedBy = rules.EliminatedByCollision, "b"
+	squad_collisions(&untouched, rules.Settings{}, squads)
+	squad_elimination(&untouched, rules.Settings{}, squads)
+	if untouched.Snakes[0].EliminatedCause != rules.EliminatedByCollision || untouched.Snakes[1].EliminatedCause != rules.NotEliminated {
+		t.Errorf("expected the squad stages to be off without their settings, got %+v", untouched.Snakes)
+	}
+	unshared := board()
+	squad_share(&unshared, rules.Settings{}, squads)
+	if a := unshared.Snakes[0]; a.Health != 50 || len(a.Body) != 3 {
+		t.Errorf("expected nothing to be shared without the settings, got %d and %d", a.Health, len(a.Body))
+	}
+}
+
+func Test_WrappedMoves(t *testing.T) {
+
+	sim := Simulation{
+		board: rules.BoardState{
+			Width:  5,
+			Height: 5,
+			Snakes: []rules.Snake{{ID: "a", Health: 100, Body: []rules.Point{{X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}}},
+		},
+		ruleset: rules.GameTypeWrapped,
+	}
+
+	moves := sim.getValidMoves("a")
+	if len(moves) != 3 {
+		t.Fatalf("expected up, down and left to be valid on a wrapped board, got %v", moves)
+	}
+
+	// Crossing the edge leaves as much room as any other move.
+	sim.priors = true
+	for i, prior := range move_priors(&sim, "a", moves) {
+		if prior < 0.25 {
+			t.Errorf("expected %s to keep its prior on a wrapped board, got %v", moves[i].Move, prior)
+		}
+	}
+
+	sim.rules_set = new_pipeline(rules.GameTypeWrapped, true, nil)
+	_, board, err := sim.executeActions([]rules.SnakeMove{{ID: "a", Move: rules.MoveLeft}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := board.Snakes[0].Body[0]; head != (rules.Point{X: 4, Y: 2}) || board.Snakes[0].EliminatedCause != rules.NotEliminated {
+		t.Fatalf("expected the snake to wrap to the other side, got %v %s", head, board.Snakes[0].EliminatedCause)
+	}
+	if move, ok := sim.observed_move(*board, "a"); !ok || move != rules.MoveLeft {
+		t.Fatalf("expected the move across the edge to be recognised, got %q", move)
+	}
+}
+
+func Test_LethalHazards(t *testing.T) {
+
+	sim := Simulation{
+		board: rules.BoardState{
+			Width:   5,
+			Height:  5,
+			Snakes:  []rules.Snake{{ID: "a", Health: 20, Body: []rules.Point{{X: 2, Y: 2}, {X: 2, Y: 1}, {X: 2, Y: 0}}}},
+			Hazards: []rules.Point{{X: 1, Y: 2}, {X: 3, Y: 2}, {X: 3, Y: 2}},
+			Food:    []rules.Point{{X: 1, Y: 2}},
+		},
+		settings:             rules.Settings{HazardDamagePerTurn: 14},
+		avoid_lethal_hazards: true,
+	}
+
+	// Left is a hazard with food on it and right is a stacked hazard doing
+	// 28 damage, so only right is lethal.
+	moves := sim.getValidMoves("a")
+	for _, move := range moves {
+		if move.Move == rules.MoveRight {
+			t.Fatalf("expected the stacked hazard to be avoided, got %v", moves)
+		}
+	}
+	if len(moves) != 2 {
+		t.Fatalf("expected up and left, got %v", moves)
+	}
+}
+
+func Test_DoomedMove(t *testing.T) {
+
+	// Up runs into b's body. Left and right are both next to another head,
+	// but c is longer while d only has our length and would die with us.
+	sim := Simulation{
+		board: rules.BoardState{
+			Width:  7,
+			Height: 7,
+			Snakes: []rules.Snake{
+				{ID: "a", Health: 50, Body: []rules.Point{{X: 3, Y: 3}, {X: 3, Y: 2}, {X: 3, Y: 1}}},
+				{ID: "b", Health: 50, Body: []rules.Point{{X: 2, Y: 5}, {X: 3, Y: 5}, {X: 3, Y: 4}, {X: 4, Y: 4}, {X: 4, Y: 5}}},
+				{ID: "c", Health: 50, Body: []rules.Point{{X: 1, Y: 3}, {X: 1, Y: 2}, {X: 1, Y: 1}, {X: 1, Y: 0}, {X: 0, Y: 0}}},
+				{ID: "d", Health: 50, Body: []rules.Point{{X: 5, Y: 3}, {X: 5, Y: 2}, {X: 5, Y: 1}}},
+			},
+		},
+	}
+	if move := sim.doomed_move(&sim.board.Snakes[0]); move.Move != rules.MoveRight {
+		t.Fatalf("expected to take d down with us, got %v", move)
+	}
+
+	// Boxed into the corner by its own body, the snake still gets a move.
+	sim.board.Snakes = []rules.Snake{
+		{ID: "a", Health: 50, Body: []rules.Point{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 1}, {X: 0, Y: 2}}},
+	}
+	moves := sim.getValidMoves("a")
+	if len(moves) != 1 {
+		t.Fatalf("expected a single last resort move, got %v", moves)
+	}
+	scratch := sim.copy()
+	if fast := new_fast_board(&sim).snake_moves(&scratch, 0, nil); len(fast) != 1 || fast_dirs[fast[0]] != moves[0].Move {
+		t.Fatalf("expected the FastBoard to pick %s as well, got %v", moves[0].Move, fast)
+	}
+}
 
-	err2 := json.Unmarshal(test_body, &state)
+func Test_BoardAnalysis(t *testing.T) {
 
-	if err2 != nil {
-		log.Printf("ERROR: Failed to decode move json, %s", err)
-		return
+	// a's body walls off the left of the board. There is more room there
+	// than on the right, but not enough for a, while on the right it can
+	// chase its own tail.
+	sim := Simulation{
+		board: rules.BoardState{
+			Width:  5,
+			Height: 3,
+			Snakes: []rules.Snake{{ID: "a", Health: 50, Body: []rules.Point{
+				{X: 2, Y: 0}, {X: 2, Y: 1}, {X: 2, Y: 2}, {X: 3, Y: 2}, {X: 4, Y: 2}, {X: 4, Y: 1}, {X: 4, Y: 0},
+			}}},
+		},
 	}
+	left, right := rules.Point{X: 1, Y: 0}, rules.Point{X: 3, Y: 0}
 
-	move(state)
+	analysis := analyse_board(&sim)
+	if room := analysis.room(left); room != 6 {
+		t.Errorf("expected 6 cells of room on the left, got %d", room)
+	}
+	if !analysis.cut[analysis.index(right)] || analysis.room(right) != 2 {
+		t.Errorf("expected the right to be a cut leaving 2 cells, got %v and %d", analysis.cut[analysis.index(right)], analysis.room(right))
+	}
+	if reach := analysis.reachable(left, 7); reach != 6 {
+		t.Errorf("expected the left pocket to stay at 6 cells, got %d", reach)
+	}
+	if reach := analysis.reachable(right, 7); reach != 7 {
+		t.Errorf("expected the tail to open up the right, got %d", reach)
+	}
+
+	moves := prune_moves(&sim, "a", sim.getValidMoves("a"))
+	if len(moves) != 1 || moves[0].Move != rules.MoveRight {
+		t.Fatalf("expected only right to be kept, got %v", moves)
+	}
+
+	// The priors judge the room the same way.
+	sim.priors = true
+	valid := sim.getValidMoves("a")
+	priors := move_priors(&sim, "a", valid)
+	for i, move := range valid {
+		if move.Move == rules.MoveLeft && priors[i] >= 0.5 {
+			t.Errorf("expected the left pocket to get the smaller prior, got %v", priors)
+		}
+	}
+}
+
+func Test_Voronoi(t *testing.T) {
+
+	// Both heads reach the middle of the corridor together, so b wins it
+	// while it is longer. a's tail moves out of the way, b's has just eaten.
+	board := rules.BoardState{
+		Width:  7,
+		Height: 1,
+		Snakes: []rules.Snake{
+			{ID: "a", Body: []rules.Point{{X: 1, Y: 0}, {X: 0, Y: 0}}},
+			{ID: "b", Body: []rules.Point{{X: 5, Y: 0}, {X: 6, Y: 0}, {X: 6, Y: 0}}},
+		},
+		Food: []rules.Point{{X: 3, Y: 0}},
+	}
+	territory := voronoi(&board, false)
+	if territory.cells["a"] != 2 || territory.cells["b"] != 2 || territory.food["b"] != 1 {
+		t.Fatalf("expected b to win the middle and its food, got %v and %v", territory.cells, territory.food)
+	}
+
+	board.Snakes[1].Body = board.Snakes[1].Body[:2]
+	territory = voronoi(&board, false)
+	if territory.cells["a"] != 2 || territory.cells["b"] != 2 || territory.food["a"]+territory.food["b"] != 0 {
+		t.Fatalf("expected the middle to be left to nobody, got %v and %v", territory.cells, territory.food)
+	}
+}
+
+func Test_SelfPlay(t *testing.T) {
+
+	food, _ := parse_agent(AGENT_FOOD)
+	random, _ := parse_agent(AGENT_RANDOM)
+	settings := ArenaSettings{games: 2, width: 11, height: 11, ruleset: rules.GameTypeStandard, seed: 3}
+
+	records := []*AgentRecord{{spec: AGENT_FOOD}, {spec: AGENT_RANDOM}}
+	for game := 0; game < settings.games; game++ {
+		result, err := play_game([]AgentFactory{food, random}, settings, game)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.turns == 0 {
+			t.Fatal("expected the game to be played")
+		}
+		if again, _ := play_game([]AgentFactory{food, random}, settings, game); again.turns != result.turns {
+			t.Fatalf("expected the same game from the same seed, got %d and %d turns", result.turns, again.turns)
+		}
+		for i, record := range records {
+			record.add(result, i)
+		}
+	}
+
+	// Two agents split every match, so their ratings mirror each other.
+	food_elo, low, high := records[0].elo()
+	random_elo, _, _ := records[1].elo()
+	if math.Abs(food_elo+random_elo) > 1e-6 || low > food_elo || high < food_elo {
+		t.Fatalf("expected mirrored ratings inside their intervals, got %v [%v, %v] and %v", food_elo, low, high, random_elo)
+	}
+
+	// After a clean sweep the estimate stays finite but the interval doesn't.
+	sweep := AgentRecord{matches: 10, score: 10}
+	if elo, low, high := sweep.elo(); math.IsInf(elo, 0) || low >= elo || !math.IsInf(high, 1) {
+		t.Fatalf("expected a finite rating under an open ended interval, got %v [%v, %v]", elo, low, high)
+	}
+
+	if _, err := parse_agent("mcts:iterations"); err == nil {
+		t.Error("expected an option without a value to be rejected")
+	}
+}
+
+func Test_Config(t *testing.T) {
+
+	if err := default_config().validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %s", err)
+	}
+
+	file := t.TempDir() + "/snake.env"
+	if err := os.WriteFile(file, []byte("iterations=100\nworkers=2\nselection=puct\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("workers", "3")
+
+	loaded, args, err := load_config([]string{"-config", file, "-exploration", "2", "selfplay", "-games", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.iterations != 100 || loaded.workers != 3 || loaded.selection != SELECT_PUCT || loaded.exploration != 2 {
+		t.Fatalf("expected flags over the environment over the file, got %+v", loaded)
+	}
+	if len(args) != 3 || args[0] != "selfplay" {
+		t.Fatalf("expected the subcommand to be left over, got %v", args)
+	}
+
+	_, _, err = load_config([]string{"-config", file, "-workers", "0", "-rollout_policy", "greedy", "-iterations", "many"})
+	if err == nil {
+		t.Fatal("expected invalid settings to be rejected")
+	}
+	for _, problem := range []string{`-iterations: "many" is not a whole number`, "workers must be at least 1", `"greedy"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to be reported, got %s", problem, err)
+		}
+	}
+
+	if _, _, err := load_config([]string{"-config", t.TempDir() + "/missing.env"}); err == nil {
+		t.Error("expected a missing config file to be an error when it was asked for")
+	}
+}
+
+func Test_DecisionRecord(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	defer func(saved Config) { config = saved }(config)
+	config.iterations = 200
+	config.time_budget = 0
+	config.decision_log = t.TempDir() + "/decisions.jsonl"
+	// Leave it to the iteration cap to stop the search, however slow the
+	// machine is.
+	state.Game.Timeout = int32(time.Minute / time.Millisecond)
+	state.You.Latency = ""
+
+	start(state)
+	defer end(state)
+	chosen := move(state, 5).Move
+	wait_decisions()
+
+	line, err := os.ReadFile(config.decision_log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := DecisionRecord{}
+	if err := json.Unmarshal(line, &record); err != nil {
+		t.Fatal(err)
+	}
+
+	visits := 0
+	for _, child := range record.Children {
+		visits += child.Visits
+	}
+	if record.GameID != state.Game.ID || record.Move != chosen || record.Seed != 5 || record.Iterations != 200 || visits != 200 {
+		t.Fatalf("expected a record of the search, got %+v", record)
+	}
+	if record.Depth < 1 || record.Nodes <= len(record.Children) {
+		t.Fatalf("expected the tree's size to be recorded, got depth %d and %d nodes", record.Depth, record.Nodes)
+	}
+	if _, ok := record.Territory[state.You.ID]; !ok {
+		t.Fatalf("expected our territory to be recorded, got %v", record.Territory)
+	}
+}
+
+func Test_Metrics(t *testing.T) {
+
+	state := GameState{Game: Game{ID: "metrics", Timeout: 100}}
+	record_move_metrics(state, 50*time.Millisecond, 400)
+	record_move_metrics(state, 150*time.Millisecond, 1200)
+	metrics.decode_errors.add("move", 1)
+
+	var out strings.Builder
+	write_metrics(&out)
+	for _, line := range []string{
+		`snake_move_latency_seconds_bucket{le="0.05"} `,
+		`snake_move_iterations_bucket{le="+Inf"} `,
+		"# TYPE snake_rollouts_total counter",
+		`snake_decode_errors_total{endpoint="move"} `,
+		"snake_move_timeouts_total ",
+		"snake_games_active ",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in the metrics, got\n%s", line, out.String())
+		}
+	}
+	if metrics.timeouts.values[""] < 1 {
+		t.Error("expected the move past the timeout to be counted")
+	}
+}
+
+func Test_SearchFailures(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+
+	// A snake without a body can't be moved, which the rules report as an error.
+	broken := simulationFromGame(&state)
+	broken.board.Snakes[1].Body = nil
+	if _, _, err := broken.executeAction(rules.SnakeMove{ID: state.You.ID, Move: rules.MoveLeft}, false); err == nil {
+		t.Fatal("expected moving a board with an empty snake to fail")
+	}
+
+	// We're at the top edge with our neck below us, so only left and right are safe.
+	safe := map[string]bool{rules.MoveLeft: true, rules.MoveRight: true}
+
+	state.Board.Snakes[1].Body = []Coord{}
+	if got := answer_move(state, 1).Move; !safe[got] {
+		t.Fatalf("expected a safe move from a failed search, got %s", got)
+	}
+	end(state)
+
+	response := func() (response BattlesnakeMoveResponse) {
+		defer recover_move(state, &response)
+		panic("search blew up")
+	}()
+	if !safe[response.Move] {
+		t.Fatalf("expected a safe move after a panic, got %s", response.Move)
+	}
+}
+
+// PanickingRollout blows up in the middle of every play out.
+type PanickingRollout struct{}
+
+func (PanickingRollout) choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove {
+	panic("rollout blew up")
+}
+
+func Test_WorkerPanics(t *testing.T) {
+
+	state := fixture_state(t, "test_request.json")
+	safe := map[string]bool{rules.MoveLeft: true, rules.MoveRight: true}
+
+	for _, mode := range []string{SEARCH_SEQUENTIAL, SEARCH_SIMULTANEOUS} {
+		settings := config
+		settings.search_mode = mode
+		settings.engine = ENGINE_RULES
+		tree := new_tree(state, settings)
+		tree.configure()
+		tree.workers = 4
+		tree.rollout = PanickingRollout{}
+		tree.deadline = time.Now().Add(time.Minute)
+		if mode == SEARCH_SEQUENTIAL {
+			if err := tree.root.expandNode(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := tree.search(100)
+		if err == nil || !strings.Contains(err.Error(), "rollout blew up") {
+			t.Fatalf("%s: expected the panic to fail the search, got %v", mode, err)
+		}
+		if got := tree.fallback_move(state); !safe[got] {
+			t.Fatalf("%s: expected a safe move after the search panicked, got %s", mode, got)
+		}
+	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A long search creates a lot of nodes, and with a tree kept between turns
+// most of them are thrown away a turn later. To keep the garbage collector
+// out of the way every node of the sequential tree comes from its tree's
+// NodePool: nodes are allocated a chunk at a time, and the nodes dropped by
+// advance and trim_tree are reused. Apart from the root and finished games,
+// nodes don't keep a board either, only the action leading to them. Their
+// board is replayed from the root's whenever the search needs it, which costs
+// a few moves of a play out.
+
+const (
+	POOL_CHUNK = 256
+	// MIN_NODE_BUDGET is the smallest max_nodes, a tree has to have room for
+	// a few turns of moves to search at all.
+	MIN_NODE_BUDGET = 100
+)
+
+type NodePool struct {
+	chunk []Node
+	free  []*Node
+	// live is how many nodes are in use, limit caps it when it isn't 0.
+	live  int
+	limit int
+}
+
+func new_node_pool(limit int) *NodePool {
+	return &NodePool{limit: limit}
+}
+
+// get returns a cleared node, reusing a released one if there is one.
+func (pool *NodePool) get() *Node {
+	pool.live += 1
+	if last := len(pool.free) - 1; last >= 0 {
+		node := pool.free[last]
+		pool.free = pool.free[:last]
+		return node
+	}
+	if len(pool.chunk) == 0 {
+		pool.chunk = make([]Node, POOL_CHUNK)
+	}
+	node := &pool.chunk[0]
+	pool.chunk = pool.chunk[1:]
+	return node
+}
+
+// release hands node and its whole subtree back to the pool. Nothing may use
+// them afterwards, so it is only called while no search is running.
+func (pool *NodePool) release(node *Node) {
+	for _, child := range node.children {
+		pool.release(child)
+	}
+	*node = Node{rewards: node.rewards[:0], children: node.children[:0]}
+	pool.free = append(pool.free, node)
+	pool.live -= 1
+}
+
+// fits is whether count more nodes stay within the budget.
+func (pool *NodePool) fits(count int) bool {
+	return pool.limit == 0 || pool.live+count <= pool.limit
+}
+
+// simulation is a copy of the node's board, replayed from the nearest kept
+// one along the actions leading to the node. The royale shrink is drawn from
+// the root's seed, see seeded_settings, so it comes out the same every time.
+// Nodes are read and added to by the search, so it is only called with the
+// tree locked.
+func (node *Node) simulation() (Simulation, error) {
+	path := []*Node{}
+	top := node
+	for ; top.board == nil; top = top.parent {
+		path = append(path, top)
+	}
+
+	board := top.board.copy()
+	for i := len(path) - 1; i >= 0; i-- {
+		if err := path[i].step(&board); err != nil {
+			return Simulation{}, err
+		}
+	}
+	return board, nil
+}
+
+// step plays the action leading to the node on its parent's board.
+func (node *Node) step(board *Simulation) error {
+	last_in_rotation := node.player_order[node.player] == (len(node.player_arr) - 1)
+	_, new_board, err := board.executeAction(node.action, last_in_rotation)
+	if err != nil {
+		return fmt.Errorf("expanding: %w", err)
+	}
+	board.board = *new_board
+	return nil
+}
+
+// trim_tree makes room for the next search once the tree kept from the last
+// turns has used up most of its node budget. The least visited subtrees are
+// cut off, turning their roots back into leaves, until half the budget is free.
+func (tree *Tree) trim_tree() {
+	pool := tree.root.pool
+	target := pool.limit / 2
+	if pool.limit == 0 || pool.live <= target {
+		return
+	}
+
+	type expanded struct {
+		node  *Node
+		depth int
+	}
+	nodes := []expanded{}
+	var collect func(node *Node, depth int)
+	collect = func(node *Node, depth int) {
+		for _, child := range node.children {
+			if len(child.children) > 0 {
+				nodes = append(nodes, expanded{child, depth})
+				collect(child, depth+1)
+			}
+		}
+	}
+	collect(tree.root, 1)
+
+	// A node has no more visits than its parent, so with deeper nodes first
+	// on ties a subtree is always cut before the node above it, and nothing
+	// that has been released is looked at again.
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].node.sims != nodes[j].node.sims {
+			return nodes[i].node.sims < nodes[j].node.sims
+		}
+		return nodes[i].depth > nodes[j].depth
+	})
+
+	before := pool.live
+	for _, cut := range nodes {
+		if pool.live <= target {
+			break
+		}
+		for _, child := range cut.node.children {
+			pool.release(child)
+		}
+		cut.node.children = cut.node.children[:0]
+	}
+	logf(LOG_DEBUG, "trimmed the tree from %d to %d nodes", before, pool.live)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Every random choice in a search comes from a generator seeded for that move,
+// so a move can be reproduced from its seed. The tree's own generator is used
+// for selection and expansion, under the tree lock, and each worker gets its
+// own for its rollouts. With a single worker and an iteration cap the same
+// seed gives the same move and the same statistics. Several workers race for
+// the lock, so their searches can't be replayed exactly.
+
+const SEED_HEADER = "X-Seed"
+
+// search_seed picks the seed for a move: the one given with the request if
+// any, then the configured seed, then the clock.
+func search_seed(requested int64) int64 {
+	if requested != 0 {
+		return requested
+	}
+	if config.seed != 0 {
+		return config.seed
+	}
+	return time.Now().UnixNano()
+}
+
+// worker_rand is the generator for one worker's rollouts.
+func worker_rand(seed int64, worker int) *rand.Rand {
+	return rand.New(rand.NewSource(seed + int64(worker) + 1))
+}
+
+// rules_rand lets a *rand.Rand stand in for rules.Rand, so stages like the
+// royale shrink draw from a play out's generator.
+type rules_rand struct {
+	*rand.Rand
+}
+
+func (r rules_rand) Range(min int, max int) int {
+	return r.Intn(max-min+1) + min
+}
+
+// seeded_settings has a board draw the royale shrink from seed and the turn,
+// as the rules do for a seeded game, rather than from a generator. The
+// sequential tree replays its boards from the root, and a replayed board has
+// to shrink the same way every time. The rules take a zero seed for none.
+func seeded_settings(settings rules.Settings, seed int64) rules.Settings {
+	if seed == 0 {
+		seed = 1
+	}
+	return settings.WithRand(nil).WithSeed(seed)
+}
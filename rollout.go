@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// RolloutPolicy picks the moves snakes make during a play out. moves is never
+// empty and only holds moves getValidMoves allowed. Any randomness comes from
+// rng, the generator of the worker running the play out.
+type RolloutPolicy interface {
+	choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove
+}
+
+const (
+	ROLLOUT_RANDOM = "random"
+	ROLLOUT_FOOD   = "food"
+	ROLLOUT_SAFE   = "safe"
+)
+
+// RandomRollout picks uniformly between the valid moves.
+type RandomRollout struct{}
+
+func (RandomRollout) choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove {
+	return moves[rng.Intn(len(moves))]
+}
+
+// FoodRollout always heads for the closest food.
+type FoodRollout struct{}
+
+func (FoodRollout) choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove {
+	return sim.find_food_moves(snake_id, moves)
+}
+
+// SafeRollout avoids moves into pockets smaller than the snake, picking
+// randomly between the moves that leave enough room. When every move is too
+// tight it takes the one with the most room.
+type SafeRollout struct{}
+
+func (SafeRollout) choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove {
+	snake := get_snake(sim.board, snake_id)
+	analysis := analyse_board(sim)
+	roomy := []rules.SnakeMove{}
+	best_move := moves[0]
+	best_space := -1
+
+	for _, move := range moves {
+		space := analysis.space(sim.neighbour(snake.Body[0], move.Move), len(snake.Body))
+		if space >= len(snake.Body) {
+			roomy = append(roomy, move)
+		}
+		if space > best_space {
+			best_space = space
+			best_move = move
+		}
+	}
+
+	if len(roomy) == 0 {
+		return best_move
+	}
+	return roomy[rng.Intn(len(roomy))]
+}
+
+// EpsilonGreedyRollout follows greedy except for a random move epsilon of the time.
+type EpsilonGreedyRollout struct {
+	epsilon float64
+	greedy  RolloutPolicy
+}
+
+func (policy EpsilonGreedyRollout) choose_move(rng *rand.Rand, sim *Simulation, snake_id string, moves []rules.SnakeMove) rules.SnakeMove {
+	if rng.Float64() < policy.epsilon {
+		return moves[rng.Intn(len(moves))]
+	}
+	return policy.greedy.choose_move(rng, sim, snake_id, moves)
+}
+
+// parse_rollout_policy reads a policy name, optionally followed by an epsilon
+// for an epsilon greedy mix, e.g. "safe" or "food:0.2".
+func parse_rollout_policy(spec string) (RolloutPolicy, error) {
+	name, epsilon_str, mixed := strings.Cut(spec, ":")
+
+	var policy RolloutPolicy
+	switch name {
+	case "", ROLLOUT_RANDOM:
+		policy = RandomRollout{}
+	case ROLLOUT_FOOD:
+		policy = FoodRollout{}
+	case ROLLOUT_SAFE:
+		policy = SafeRollout{}
+	default:
+		return nil, fmt.Errorf("unknown rollout policy %q", name)
+	}
+
+	if !mixed {
+		return policy, nil
+	}
+
+	epsilon, err := strconv.ParseFloat(epsilon_str, 64)
+	if err != nil || epsilon < 0 || epsilon > 1 {
+		return nil, fmt.Errorf("rollout epsilon must be between 0 and 1, got %q", epsilon_str)
+	}
+	return EpsilonGreedyRollout{epsilon: epsilon, greedy: policy}, nil
+}
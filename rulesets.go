@@ -0,0 +1,254 @@
+package main
+
+import (
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Simulations follow the rules of the mode the game is actually played in.
+// The rules package provides the stages for every mode except squad, which it
+// has dropped, so the squad stages live here.
+//
+// Royale shrinking is our own too. The engine picks the side that shrinks from
+// the game's seed, which we never see, and rules.PopulateHazardsRoyale rebuilds
+// every hazard from that seed. Running it with any other seed would throw away
+// the hazards we were sent, so instead we keep them and shrink a random side of
+// the remaining safe area.
+
+const (
+	GAME_TYPE_SQUAD = "squad"
+
+	STAGE_SHRINK_ROYALE     = "spawn_hazards.shrink_observed"
+	STAGE_SQUAD_COLLISIONS  = "squad.allow_body_collisions"
+	STAGE_SQUAD_ELIMINATION = "squad.shared_elimination"
+	STAGE_SQUAD_SHARE       = "squad.share_attributes"
+
+	ELIMINATED_BY_SQUAD = "squad-eliminated"
+)
+
+// ruleset_stages lists the pipeline stages for a game mode, in the order the
+// engine runs them. Unknown modes are played as standard.
+func ruleset_stages(name string, solo bool) []string {
+	stages := []string{rules.StageGameOverStandard}
+	if solo {
+		stages = []string{rules.StageGameOverSoloSnake}
+	}
+
+	stages = append(stages,
+		rules.StageMovementStandard,
+		rules.StageStarvationStandard,
+		rules.StageHazardDamageStandard,
+		rules.StageFeedSnakesStandard,
+		rules.StageEliminationStandard,
+	)
+
+	switch name {
+	case rules.GameTypeWrapped:
+		stages[1] = rules.StageMovementWrapBoundaries
+	case rules.GameTypeRoyale:
+		stages = append(stages, STAGE_SHRINK_ROYALE)
+	case rules.GameTypeConstrictor:
+		stages = append(stages, rules.StageSpawnFoodNoFood, rules.StageModifySnakesAlwaysGrow)
+	case GAME_TYPE_SQUAD:
+		stages = append(stages, STAGE_SQUAD_COLLISIONS, STAGE_SQUAD_ELIMINATION, STAGE_SQUAD_SHARE)
+	}
+	return stages
+}
+
+// new_pipeline builds the pipeline for a game mode. squads maps snake IDs to
+// their squad and is only used by the squad stages.
+func new_pipeline(name string, solo bool, squads map[string]string) rules.Pipeline {
+	registry := rules.StageRegistry{
+		rules.StageGameOverStandard:       rules.GameOverStandard,
+		rules.StageGameOverSoloSnake:      rules.GameOverSolo,
+		rules.StageMovementStandard:       rules.MoveSnakesStandard,
+		rules.StageMovementWrapBoundaries: rules.MoveSnakesWrapped,
+		rules.StageStarvationStandard:     rules.ReduceSnakeHealthStandard,
+		rules.StageHazardDamageStandard:   rules.DamageHazardsStandard,
+		rules.StageFeedSnakesStandard:     rules.FeedSnakesStandard,
+		rules.StageEliminationStandard:    rules.EliminateSnakesStandard,
+		rules.StageSpawnFoodNoFood:        rules.RemoveFoodConstrictor,
+		rules.StageModifySnakesAlwaysGrow: rules.GrowSnakesConstrictor,
+		STAGE_SHRINK_ROYALE:               shrink_royale,
+		STAGE_SQUAD_COLLISIONS: func(b *rules.BoardState, settings rules.Settings, moves []rules.SnakeMove) (bool, error) {
+			return squad_collisions(b, settings, squads)
+		},
+		STAGE_SQUAD_ELIMINATION: func(b *rules.BoardState, settings rules.Settings, moves []rules.SnakeMove) (bool, error) {
+			return squad_elimination(b, settings, squads)
+		},
+		STAGE_SQUAD_SHARE: func(b *rules.BoardState, settings rules.Settings, moves []rules.SnakeMove) (bool, error) {
+			return squad_share(b, settings, squads)
+		},
+	}
+	return rules.NewPipelineFromRegistry(registry, ruleset_stages(name, solo)...)
+}
+
+// is_game_over checks the board the same way the first stage of the pipeline
+// does, without running the rest of it.
+func (game *Simulation) is_game_over() bool {
+	if game.solo {
+		over, _ := rules.GameOverSolo(&game.board, game.settings, nil)
+		return over
+	}
+	if game.ruleset == GAME_TYPE_SQUAD {
+		return squad_game_over(&game.board, game.squads)
+	}
+	over, _ := rules.GameOverStandard(&game.board, game.settings, nil)
+	return over
+}
+
+// end_turn runs the stages the engine applies once every snake has moved and
+// advances the turn.
+func (game *Simulation) end_turn() error {
+	var err error
+	switch game.ruleset {
+	case rules.GameTypeRoyale:
+		_, err = shrink_royale(&game.board, game.settings, nil)
+	case rules.GameTypeConstrictor:
+		rules.RemoveFoodConstrictor(&game.board, game.settings, nil)
+		_, err = rules.GrowSnakesConstrictor(&game.board, game.settings, nil)
+	case GAME_TYPE_SQUAD:
+		_, err = squad_share(&game.board, game.settings, game.squads)
+	}
+	game.board.Turn += 1
+	return err
+}
+
+// shrink_royale adds a row or column of hazards on a random side of the safe
+// area every ShrinkEveryNTurns turns. The side comes from the settings'
+// generator, which is the search's one during a search.
+func shrink_royale(b *rules.BoardState, settings rules.Settings, moves []rules.SnakeMove) (bool, error) {
+	shrink_every := settings.RoyaleSettings.ShrinkEveryNTurns
+	turn := b.Turn + 1
+	if shrink_every < 1 || turn%shrink_every != 0 {
+		return false, nil
+	}
+
+	hazard := make([]bool, b.Width*b.Height)
+	for _, p := range b.Hazards {
+		if p.X >= 0 && p.X < b.Width && p.Y >= 0 && p.Y < b.Height {
+			hazard[p.Y*b.Width+p.X] = true
+		}
+	}
+
+	min_x, max_x, min_y, max_y := b.Width, -1, b.Height, -1
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			if hazard[y*b.Width+x] {
+				continue
+			}
+			min_x, max_x = min_int(min_x, x), max_int(max_x, x)
+			min_y, max_y = min_int(min_y, y), max_int(max_y, y)
+		}
+	}
+	if max_x < 0 {
+		return false, nil
+	}
+
+	switch settings.GetRand(b.Turn).Intn(4) {
+	case 0:
+		max_x = min_x
+	case 1:
+		min_x = max_x
+	case 2:
+		max_y = min_y
+	case 3:
+		min_y = max_y
+	}
+	for y := min_y; y <= max_y; y++ {
+		for x := min_x; x <= max_x; x++ {
+			if !hazard[y*b.Width+x] {
+				b.Hazards = append(b.Hazards, rules.Point{X: x, Y: y})
+			}
+		}
+	}
+	return false, nil
+}
+
+// squad_collisions brings back snakes that ran into a squadmate's body when
+// the squad is allowed to overlap.
+func squad_collisions(b *rules.BoardState, settings rules.Settings, squads map[string]string) (bool, error) {
+	if !settings.SquadSettings.AllowBodyCollisions {
+		return false, nil
+	}
+	for i := range b.Snakes {
+		snake := &b.Snakes[i]
+		if snake.EliminatedCause != rules.EliminatedByCollision {
+			continue
+		}
+		if squads[snake.ID] != "" && squads[snake.ID] == squads[snake.EliminatedBy] {
+			snake.EliminatedCause = rules.NotEliminated
+			snake.EliminatedBy = ""
+		}
+	}
+	return false, nil
+}
+
+// squad_elimination takes out the whole squad when one of them is eliminated.
+func squad_elimination(b *rules.BoardState, settings rules.Settings, squads map[string]string) (bool, error) {
+	if !settings.SquadSettings.SharedElimination {
+		return false, nil
+	}
+	for i := range b.Snakes {
+		snake := &b.Snakes[i]
+		if snake.EliminatedCause != rules.NotEliminated || squads[snake.ID] == "" {
+			continue
+		}
+		for _, other := range b.Snakes {
+			if other.ID != snake.ID && squads[other.ID] == squads[snake.ID] &&
+				other.EliminatedCause != rules.NotEliminated && other.EliminatedCause != ELIMINATED_BY_SQUAD {
+				snake.EliminatedCause = ELIMINATED_BY_SQUAD
+				snake.EliminatedBy = other.ID
+				break
+			}
+		}
+	}
+	return false, nil
+}
+
+// squad_share gives every living member of a squad the best health and
+// length in the squad.
+func squad_share(b *rules.BoardState, settings rules.Settings, squads map[string]string) (bool, error) {
+	health := map[string]int{}
+	length := map[string]int{}
+	for _, snake := range b.Snakes {
+		squad := squads[snake.ID]
+		if snake.EliminatedCause != rules.NotEliminated || squad == "" {
+			continue
+		}
+		health[squad] = max_int(health[squad], snake.Health)
+		length[squad] = max_int(length[squad], len(snake.Body))
+	}
+
+	for i := range b.Snakes {
+		snake := &b.Snakes[i]
+		squad := squads[snake.ID]
+		if snake.EliminatedCause != rules.NotEliminated || squad == "" || len(snake.Body) == 0 {
+			continue
+		}
+		if settings.SquadSettings.SharedHealth {
+			snake.Health = health[squad]
+		}
+		if settings.SquadSettings.SharedLength {
+			for len(snake.Body) < length[squad] {
+				snake.Body = append(snake.Body, snake.Body[len(snake.Body)-1])
+			}
+		}
+	}
+	return false, nil
+}
+
+// squad_game_over ends the game once everyone left is on the same squad.
+func squad_game_over(b *rules.BoardState, squads map[string]string) bool {
+	left := map[string]bool{}
+	for _, snake := range b.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		squad := squads[snake.ID]
+		if squad == "" {
+			squad = "snake:" + snake.ID
+		}
+		left[squad] = true
+	}
+	return len(left) <= 1
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Scenarios are recorded move requests with the moves we must, or must never,
+// make from them. Each line of scenarios.jsonl is one scenario.
+type Scenario struct {
+	Name       string    `json:"name"`
+	Seed       int64     `json:"seed"`
+	Iterations int       `json:"iterations"`
+	Expect     []string  `json:"expect"`
+	Forbid     []string  `json:"forbid"`
+	Request    GameState `json:"request"`
+}
+
+func load_scenarios(path string) ([]Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scenarios := []Scenario{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		scenario := Scenario{}
+		if err := json.Unmarshal(scanner.Bytes(), &scenario); err != nil {
+			return nil, err
+		}
+		scenarios = append(scenarios, scenario)
+	}
+	return scenarios, scanner.Err()
+}
+
+// check returns why move fails the scenario, or "" if it passes.
+func (scenario Scenario) check(move string) string {
+	for _, forbidden := range scenario.Forbid {
+		if move == forbidden {
+			return "made forbidden move " + move
+		}
+	}
+	if len(scenario.Expect) == 0 {
+		return ""
+	}
+	for _, expected := range scenario.Expect {
+		if move == expected {
+			return ""
+		}
+	}
+	return "made " + move + ", expected " + strings.Join(scenario.Expect, " or ")
+}
+
+// Test_Scenarios runs move() on every scenario with a single worker, the
+// scenario's seed and iteration cap, so a failure can be rerun as it was. The
+// deadline is pushed out of the way, otherwise how far the search gets would
+// depend on the machine.
+func Test_Scenarios(t *testing.T) {
+
+	scenarios, err := load_scenarios("scenarios.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved Config) { config = saved }(config)
+	config.workers = 1
+	config.time_budget = 0
+	for _, scenario := range scenarios {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			config.iterations = scenario.Iterations
+
+			state := scenario.Request
+			state.Game.Timeout = int32(time.Hour / time.Millisecond)
+			state.You.Latency = ""
+			defer end(state)
+			got := move(state, scenario.Seed).Move
+
+			if failure := scenario.check(got); failure != "" {
+				t.Errorf("seed %d: %s", scenario.Seed, failure)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// SelectionPolicy scores the children of a node during selection, the child
+// with the highest score is followed. parent_sims is the visit count of the
+// node being selected from.
+type SelectionPolicy interface {
+	score(arm ArmStats, parent_sims int) float64
+}
+
+// ArmStats is what selection sees of a child node, or of one snake's move in
+// the simultaneous tree. value and sq_value are the sum and the sum of squares
+// of the rewards of the snake making the move.
+type ArmStats struct {
+	sims     int
+	value    float64
+	sq_value float64
+	prior    float64
+}
+
+const (
+	SELECT_UCB1       = "ucb1"
+	SELECT_UCB1_TUNED = "ucb1-tuned"
+	SELECT_PUCT       = "puct"
+	SELECT_THOMPSON   = "thompson"
+
+	DEFAULT_EXPLORATION = 1.141
+)
+
+// parse_selection_policy reads a policy name. rng is only used by Thompson
+// sampling and must be the tree's generator, since selection runs under the
+// tree lock.
+func parse_selection_policy(name string, c float64, rng *rand.Rand) (SelectionPolicy, error) {
+	switch name {
+	case "", SELECT_UCB1:
+		return UCB1{c: c}, nil
+	case SELECT_UCB1_TUNED:
+		return UCB1Tuned{c: c}, nil
+	case SELECT_PUCT:
+		return PUCT{c: c}, nil
+	case SELECT_THOMPSON:
+		return Thompson{rng: rng}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection policy %q", name)
+	}
+}
+
+// UCB1 is the classic upper confidence bound, mean + c * sqrt(ln N / n).
+type UCB1 struct {
+	c float64
+}
+
+func (policy UCB1) score(arm ArmStats, parent_sims int) float64 {
+	if arm.sims == 0 {
+		return math.Inf(1)
+	}
+	sims := float64(arm.sims)
+	return arm.value/sims + policy.c*math.Sqrt(math.Log(float64(parent_sims))/sims)
+}
+
+// UCB1Tuned shrinks the exploration term for moves whose rewards vary little.
+type UCB1Tuned struct {
+	c float64
+}
+
+func (policy UCB1Tuned) score(arm ArmStats, parent_sims int) float64 {
+	if arm.sims == 0 {
+		return math.Inf(1)
+	}
+	sims := float64(arm.sims)
+	log_parent := math.Log(float64(parent_sims))
+	mean := arm.value / sims
+	variance := arm.sq_value/sims - mean*mean + math.Sqrt(2*log_parent/sims)
+	return mean + policy.c*math.Sqrt(log_parent/sims*math.Min(0.25, variance))
+}
+
+// PUCT weights exploration by the move's prior, as in AlphaZero.
+type PUCT struct {
+	c float64
+}
+
+func (policy PUCT) score(arm ArmStats, parent_sims int) float64 {
+	mean := 0.0
+	if arm.sims > 0 {
+		mean = arm.value / float64(arm.sims)
+	}
+	return mean + policy.c*arm.prior*math.Sqrt(float64(parent_sims))/float64(1+arm.sims)
+}
+
+// Thompson samples each move's win rate from a beta posterior.
+type Thompson struct {
+	rng *rand.Rand
+}
+
+func (policy Thompson) score(arm ArmStats, parent_sims int) float64 {
+	wins := math.Max(arm.value, 0)
+	losses := math.Max(float64(arm.sims)-arm.value, 0)
+	return sample_beta(policy.rng, wins+1, losses+1)
+}
+
+func sample_beta(rng *rand.Rand, alpha float64, beta float64) float64 {
+	x := sample_gamma(rng, alpha)
+	y := sample_gamma(rng, beta)
+	return x / (x + y)
+}
+
+// sample_gamma uses Marsaglia and Tsang's method, which needs shape >= 1.
+// Every shape here is at least 1 since the beta parameters start at 1.
+func sample_gamma(rng *rand.Rand, shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// move_priors gives each move a prior proportional to the room it leaves the
+// snake, so PUCT looks at moves into open space first.
+func move_priors(sim *Simulation, snake_id string, moves []rules.SnakeMove) []float64 {
+	priors := make([]float64, len(moves))
+	snake := get_snake(sim.board, snake_id)
+	if !sim.priors || snake == nil || len(snake.Body) == 0 {
+		for i := range priors {
+			priors[i] = 1 / float64(len(moves))
+		}
+		return priors
+	}
+
+	analysis := analyse_board(sim)
+	total := 0.0
+	for i, move := range moves {
+		priors[i] = float64(analysis.space(sim.neighbour(snake.Body[0], move.Move), len(snake.Body)) + 1)
+		total += priors[i]
+	}
+	for i := range priors {
+		priors[i] /= total
+	}
+	return priors
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// The self-play arena plays whole games in process between agents, so a change
+// can be judged without deploying the snake. Every agent gets a snake in every
+// game and the seats are rotated between games. Agents are given as specs:
+//
+//	random                            a random valid move
+//	food                              heads for the closest food
+//	mcts                              the search, as configured
+//	mcts:iterations=200,selection=puct  the search with some settings overridden
+//
+// The overrides use the same names as the config file.
+
+const (
+	AGENT_RANDOM = "random"
+	AGENT_FOOD   = "food"
+	AGENT_MCTS   = "mcts"
+
+	// Games that go on this long are called a draw between everyone left.
+	ARENA_MAX_TURNS = 1000
+)
+
+// Agent picks the moves for one snake in one game.
+type Agent interface {
+	choose_move(state GameState, sim *Simulation, deadline time.Time, seed int64) string
+}
+
+// AgentFactory makes a fresh agent for every game, so no agent carries a tree
+// from one game into the next. seed is for agents that move randomly.
+type AgentFactory func(seed int64) Agent
+
+type RandomAgent struct {
+	rng *rand.Rand
+}
+
+func (agent *RandomAgent) choose_move(state GameState, sim *Simulation, deadline time.Time, seed int64) string {
+	moves := sim.getValidMoves(state.You.ID)
+	if len(moves) == 0 {
+		return rules.MoveDown
+	}
+	return moves[agent.rng.Intn(len(moves))].Move
+}
+
+type FoodAgent struct{}
+
+func (FoodAgent) choose_move(state GameState, sim *Simulation, deadline time.Time, seed int64) string {
+	moves := sim.getValidMoves(state.You.ID)
+	if len(moves) == 0 {
+		return rules.MoveDown
+	}
+	return sim.find_food_moves(state.You.ID, moves).Move
+}
+
+// MctsAgent searches like the server does, but keeps its own tree and its
+// own configuration.
+type MctsAgent struct {
+	config Config
+	tree   *Tree
+}
+
+func (agent *MctsAgent) choose_move(state GameState, sim *Simulation, deadline time.Time, seed int64) string {
+	if agent.tree == nil || !agent.tree.advance(state) {
+		agent.tree = new_tree(state, agent.config)
+	}
+	agent.tree.deadline = deadline
+	agent.tree.reseed(seed)
+	move, err := agent.tree.monte_move()
+	if err != nil {
+		logf(LOG_ERROR, "ERROR: %s search failed on turn %d, %s", state.Game.ID, state.Turn, err)
+		fallback := agent.tree.fallback_move(state)
+		agent.tree = nil
+		return fallback
+	}
+	return move.Move
+}
+
+// parse_agent reads an agent spec, see the top of the file.
+func parse_agent(spec string) (AgentFactory, error) {
+	name, options, _ := strings.Cut(spec, ":")
+	switch name {
+	case AGENT_RANDOM:
+		return func(seed int64) Agent { return &RandomAgent{rng: rand.New(rand.NewSource(seed))} }, nil
+	case AGENT_FOOD:
+		return func(seed int64) Agent { return FoodAgent{} }, nil
+	case AGENT_MCTS:
+		agent_config := config
+		for _, option := range strings.Split(options, ",") {
+			if option == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(option, "=")
+			if !ok {
+				return nil, fmt.Errorf("agent option %q is not key=value", option)
+			}
+			if err := agent_config.set(key, value); err != nil {
+				return nil, fmt.Errorf("agent option %s: %w", key, err)
+			}
+		}
+		if err := agent_config.validate(); err != nil {
+			return nil, err
+		}
+		return func(seed int64) Agent { return &MctsAgent{config: agent_config} }, nil
+	default:
+		return nil, fmt.Errorf("unknown agent %q", name)
+	}
+}
+
+type ArenaSettings struct {
+	games   int
+	width   int
+	height  int
+	ruleset string
+	timeout time.Duration
+	seed    int64
+}
+
+// GameResult is what the arena keeps of a game, indexed by agent.
+type GameResult struct {
+	turns int
+	// eliminated_at is the turn each agent's snake died, or turns+1 if it
+	// was still alive at the end. Later is better.
+	eliminated_at []int
+	length        []int
+}
+
+// play_game plays one game between the agents. Agent i plays snake i+game, so
+// the starting positions rotate from game to game.
+func play_game(factories []AgentFactory, settings ArenaSettings, game int) (GameResult, error) {
+	seed := settings.seed + int64(game)
+	rng := rand.New(rand.NewSource(seed))
+
+	ids := []string{}
+	agents := map[string]Agent{}
+	agent_index := map[string]int{}
+	for i, factory := range factories {
+		id := fmt.Sprintf("snake-%d", (i+game)%len(factories))
+		ids = append(ids, id)
+		agents[id] = factory(seed + int64(i))
+		agent_index[id] = i
+	}
+
+	board, err := rules.CreateDefaultBoardState(rules_rand{rng}, settings.width, settings.height, ids)
+	if err != nil {
+		return GameResult{}, fmt.Errorf("setting up game %d: %w", game, err)
+	}
+	sim := Simulation{
+		board: *board,
+		settings: rules.Settings{
+			FoodSpawnChance:     15,
+			MinimumFood:         1,
+			HazardDamagePerTurn: 14,
+			RoyaleSettings:      rules.RoyaleSettings{ShrinkEveryNTurns: 25},
+		}.WithRand(rules_rand{rng}),
+		rules_set: new_pipeline(settings.ruleset, len(ids) == 1, nil),
+		ruleset:   settings.ruleset,
+		solo:      len(ids) == 1,
+	}
+
+	result := GameResult{
+		eliminated_at: make([]int, len(factories)),
+		length:        make([]int, len(factories)),
+	}
+	for !sim.is_game_over() && sim.board.Turn < ARENA_MAX_TURNS {
+		moves := []rules.SnakeMove{}
+		for _, snake := range sim.board.Snakes {
+			if snake.EliminatedCause != rules.NotEliminated {
+				continue
+			}
+			state := arena_state(&sim, settings, fmt.Sprintf("arena-%d", game), snake.ID)
+			deadline := time.Now().Add(settings.timeout)
+			move := agents[snake.ID].choose_move(state, &sim, deadline, seed+int64(sim.board.Turn))
+			moves = append(moves, rules.SnakeMove{ID: snake.ID, Move: move})
+		}
+
+		_, next, err := sim.executeActions(moves)
+		if err != nil {
+			return GameResult{}, fmt.Errorf("game %d turn %d: %w", game, sim.board.Turn, err)
+		}
+		sim.board = *next
+		spawn_food(rng, &sim)
+
+		for _, snake := range sim.board.Snakes {
+			i := agent_index[snake.ID]
+			if snake.EliminatedCause != rules.NotEliminated && result.eliminated_at[i] == 0 {
+				result.eliminated_at[i] = sim.board.Turn
+			}
+		}
+	}
+
+	result.turns = sim.board.Turn
+	for _, snake := range sim.board.Snakes {
+		i := agent_index[snake.ID]
+		if result.eliminated_at[i] == 0 {
+			result.eliminated_at[i] = result.turns + 1
+		}
+		result.length[i] = len(snake.Body)
+	}
+	return result, nil
+}
+
+// spawn_food does what the engine's standard map does between turns, from
+// the arena's generator so a game can be replayed from its seed.
+func spawn_food(rng *rand.Rand, sim *Simulation) {
+	settings := sim.settings
+	missing := settings.MinimumFood - len(sim.board.Food)
+	if missing <= 0 && rng.Intn(100) < settings.FoodSpawnChance {
+		missing = 1
+	}
+	if missing > 0 && sim.ruleset != rules.GameTypeConstrictor {
+		rules.PlaceFoodRandomly(rules_rand{rng}, &sim.board, missing)
+	}
+}
+
+// arena_state is the move request the engine would send snake_id.
+func arena_state(sim *Simulation, settings ArenaSettings, game_id string, snake_id string) GameState {
+	state := GameState{
+		Game: Game{
+			ID: game_id,
+			Ruleset: Ruleset{
+				Name: settings.ruleset,
+				Settings: Settings{
+					FoodSpawnChance:     int32(sim.settings.FoodSpawnChance),
+					MinimumFood:         int32(sim.settings.MinimumFood),
+					HazardDamagePerTurn: int32(sim.settings.HazardDamagePerTurn),
+					Royale:              Royale{ShrinkEveryNTurns: int32(sim.settings.RoyaleSettings.ShrinkEveryNTurns)},
+				},
+			},
+			Timeout: int32(settings.timeout / time.Millisecond),
+		},
+		Turn: sim.board.Turn,
+		Board: Board{
+			Height:  sim.board.Height,
+			Width:   sim.board.Width,
+			Food:    convert_coords(sim.board.Food),
+			Hazards: convert_coords(sim.board.Hazards),
+		},
+	}
+	for _, snake := range sim.board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		api_snake := Battlesnake{
+			ID:     snake.ID,
+			Name:   snake.ID,
+			Health: int32(snake.Health),
+			Body:   convert_coords(snake.Body),
+			Head:   Coord{X: snake.Body[0].X, Y: snake.Body[0].Y},
+			Length: int32(len(snake.Body)),
+		}
+		state.Board.Snakes = append(state.Board.Snakes, api_snake)
+		if snake.ID == snake_id {
+			state.You = api_snake
+		}
+	}
+	return state
+}
+
+func convert_coords(points []rules.Point) []Coord {
+	coords := []Coord{}
+	for _, p := range points {
+		coords = append(coords, Coord{X: p.X, Y: p.Y})
+	}
+	return coords
+}
+
+// AgentRecord sums up an agent's games. Every other agent in a game counts as
+// a match, won by whoever was eliminated later, for the Elo estimate.
+type AgentRecord struct {
+	spec    string
+	games   int
+	wins    int
+	draws   int
+	length  int
+	matches int
+	score   float64
+}
+
+func (record *AgentRecord) add(result GameResult, i int) {
+	record.games += 1
+	record.length += result.length[i]
+
+	best := true
+	shared := false
+	for j, eliminated_at := range result.eliminated_at {
+		if j == i {
+			continue
+		}
+		record.matches += 1
+		switch {
+		case result.eliminated_at[i] > eliminated_at:
+			record.score += 1
+		case result.eliminated_at[i] == eliminated_at:
+			record.score += 0.5
+			shared = true
+		default:
+			best = false
+		}
+	}
+	if best && shared {
+		record.draws += 1
+	} else if best {
+		record.wins += 1
+	}
+}
+
+// elo is the rating difference to the average opponent, with a 95% confidence
+// interval from the Wilson interval of the match score, which unlike the
+// normal approximation still has a width after a clean sweep. Only the
+// estimate is kept finite, after a clean sweep the interval is open ended.
+func (record *AgentRecord) elo() (float64, float64, float64) {
+	const z = 1.96
+	n := float64(record.matches)
+	p := record.score / n
+	center := (p + z*z/(2*n)) / (1 + z*z/n)
+	margin := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / (1 + z*z/n)
+	estimate := math.Max(0.5/n, math.Min(1-0.5/n, p))
+	return elo_diff(estimate), elo_diff(center - margin), elo_diff(center + margin)
+}
+
+// elo_diff turns a score into a rating difference. A clean sweep is infinitely
+// far ahead, so estimates treat it as half a game short of perfect.
+func elo_diff(p float64) float64 {
+	return 400 * math.Log10(p/(1-p))
+}
+
+// selfplay is the selfplay subcommand.
+func selfplay(args []string) {
+	flags := flag.NewFlagSet("selfplay", flag.ExitOnError)
+	settings := ArenaSettings{}
+	flags.IntVar(&settings.games, "games", 20, "number of games to play")
+	flags.IntVar(&settings.width, "width", 11, "board width")
+	flags.IntVar(&settings.height, "height", 11, "board height")
+	flags.StringVar(&settings.ruleset, "ruleset", rules.GameTypeStandard, "game mode")
+	timeout := flags.Int("timeout", 100, "search time per move in milliseconds")
+	flags.Int64Var(&settings.seed, "seed", 1, "seed of the first game")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: selfplay [flags] agent agent...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	settings.timeout = time.Duration(*timeout) * time.Millisecond
+
+	specs := flags.Args()
+	if len(specs) == 0 {
+		specs = []string{AGENT_MCTS, AGENT_FOOD}
+	}
+	if len(specs) < 2 {
+		fmt.Fprintln(os.Stderr, "selfplay needs at least 2 agents to play each other")
+		flags.Usage()
+		os.Exit(2)
+	}
+	factories := []AgentFactory{}
+	records := []*AgentRecord{}
+	for _, spec := range specs {
+		factory, err := parse_agent(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		factories = append(factories, factory)
+		records = append(records, &AgentRecord{spec: spec})
+	}
+
+	total_turns := 0
+	for game := 0; game < settings.games; game++ {
+		result, err := play_game(factories, settings, game)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		total_turns += result.turns
+		for i, record := range records {
+			record.add(result, i)
+		}
+		fmt.Printf("game %d: %d turns, eliminated at %v\n", game+1, result.turns, result.eliminated_at)
+	}
+
+	fmt.Printf("\n%d games, %.1f turns on average\n\n", settings.games, float64(total_turns)/float64(settings.games))
+	fmt.Printf("%-40s %6s %6s %6s %8s %8s  %s\n", "agent", "games", "wins", "draws", "win%", "length", "elo (95% ci)")
+	for _, record := range records {
+		elo, low, high := record.elo()
+		fmt.Printf("%-40s %6d %6d %6d %7.1f%% %8.1f  %+.0f [%+.0f, %+.0f]\n",
+			record.spec, record.games, record.wins, record.draws,
+			100*float64(record.wins)/float64(record.games),
+			float64(record.length)/float64(record.games), elo, low, high)
+	}
+}
@@ -1,37 +1,74 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
-	"os"
-	"strconv"
+	"sync"
+	"time"
 
 	"github.com/BattlesnakeOfficial/rules"
-	"github.com/joho/godotenv"
 )
 
 type Tree struct {
-	player string
-	root   *Node
-	name   string
+	player     string
+	mode       string
+	root       *Node
+	joint_root *JointNode
+	name       string
+	turn       int
+	deadline   time.Time
+	workers    int
+	rollout    RolloutPolicy
+
+	rollout_depth int
+	evaluator     BoardEvaluator
+	rewards       RewardSettings
+	selection     SelectionPolicy
+
+	// seed is the seed of the current move's search, rng the tree's generator
+	// seeded with it. The generator is kept across moves so the boards in the
+	// tree can hold on to it.
+	seed int64
+	rng  *rand.Rand
+	// iterations is how many simulations the last search completed, depth
+	// how far below the root the deepest node it played out from was.
+	iterations int
+	depth      int
+
+	config Config
+
+	// lock guards the nodes while several workers search the same tree.
+	// Only selection, expansion and back propagation hold it, the rollouts
+	// themselves run in parallel.
+	lock sync.Mutex
 }
 
 type Node struct {
 	player       string
 	children     []*Node
 	parent       *Node
-	board        Simulation
 	sims         int
-	wins         int
 	action       rules.SnakeMove
 	player_order map[string]int
 	player_arr   []string
-}
 
-const c float64 = 1.141
-const DEBUG_MODE = false
+	// board is only kept by the root and where the game is over, see
+	// simulation.
+	board *Simulation
+	pool  *NodePool
+
+	// rewards is the total reward of every player over the rollouts through
+	// this node, indexed like player_arr. Each node is judged by the reward
+	// of the player who moved into it (max^n).
+	rewards []float64
+	// sq_value is the sum of the squared rewards of the player who moved
+	// into this node, for UCB1-Tuned.
+	sq_value float64
+	prior    float64
+}
 
-func new_tree(game GameState) Tree {
+func new_tree(game GameState, config Config) *Tree {
 	player_order := make(map[string]int)
 	player_arr := []string{}
 	player_arr = append(player_arr, game.You.ID)
@@ -41,31 +78,57 @@ func new_tree(game GameState) Tree {
 		}
 	}
 
-	for _, id := range player_arr {
-		println(id)
-	}
-
 	for i, snake := range player_arr {
 		player_order[snake] = i
 	}
-	tree := Tree{
-		player: game.You.ID,
-		name:   game.You.Name,
-		root: &Node{
-			player_arr:   player_arr,
-			player_order: player_order,
-			children:     []*Node{},
-			parent:       nil,
-			board:        simulationFromGame(&game),
-			wins:         0,
-			sims:         0,
-		},
+	board := search_board(game, config)
+
+	if config.search_mode == SEARCH_SIMULTANEOUS {
+		return &Tree{
+			player:     game.You.ID,
+			mode:       SEARCH_SIMULTANEOUS,
+			name:       game.You.Name,
+			turn:       game.Turn,
+			joint_root: new_joint_node(nil, board, nil),
+			rollout:    RandomRollout{},
+			selection:  UCB1{c: DEFAULT_EXPLORATION},
+			rng:        rand.New(rand.NewSource(1)),
+			config:     config,
+		}
+	}
+
+	pool := new_node_pool(config.max_nodes)
+	root := pool.get()
+	root.player_arr = player_arr
+	root.player_order = player_order
+	root.board = &board
+	root.pool = pool
+	root.rewards = make([]float64, len(player_arr))
+
+	tree := &Tree{
+		player:    game.You.ID,
+		mode:      SEARCH_SEQUENTIAL,
+		name:      game.You.Name,
+		turn:      game.Turn,
+		rollout:   RandomRollout{},
+		selection: UCB1{c: DEFAULT_EXPLORATION},
+		rng:       rand.New(rand.NewSource(1)),
+		config:    config,
+		root:      root,
 	}
 	tree.root.player = tree.root.get_prev_player(game.You.ID)
-	println("previous player for", game.You.ID, "is", tree.root.player)
+	logf(LOG_DEBUG, "previous player for %s is %s", game.You.ID, tree.root.player)
 	return tree
 }
 
+// search_board is the simulation a tree searches from for the given state.
+func search_board(game GameState, config Config) Simulation {
+	board := simulationFromGame(&game)
+	board.avoid_lethal_hazards = config.avoid_lethal_hazards
+	board.priors = config.selection == SELECT_PUCT
+	return board
+}
+
 func (node *Node) get_next_player(snake_id string) string {
 	order := node.player_order[snake_id]
 	return node.player_arr[(order+1)%len(node.player_arr)]
@@ -78,34 +141,189 @@ func (node *Node) get_prev_player(snake_id string) string {
 	return node.player_arr[(order-1)%len(node.player_arr)]
 }
 
-func (tree *Tree) monte_move() rules.SnakeMove {
+// monte_move searches with the tree's configuration and returns the best move.
+// When the search fails the tree may be half updated, so the caller should fall
+// back to fallback_move and drop the tree.
+func (tree *Tree) monte_move() (rules.SnakeMove, error) {
+	tree.configure()
+
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		tree.joint_root.board.settings = tree.joint_root.board.settings.WithRand(rules_rand{tree.rng})
+		tree.prune_root()
+		if err := tree.search(tree.config.iterations); err != nil {
+			return rules.SnakeMove{}, err
+		}
+		return tree.joint_root.select_best_move(tree.player, tree.name), nil
+	}
 
-	godotenv.Load(".env")
-	iterations, err := strconv.Atoi(os.Getenv("iterations"))
-	if err != nil {
-		println(err.Error())
-		panic("error")
+	// The root keeps its seed for as long as the tree is reused, the boards
+	// below it were searched with its shrinks.
+	if tree.root.board.settings.Seed() == 0 {
+		tree.root.board.settings = seeded_settings(tree.root.board.settings, tree.seed)
+	}
+
+	tree.trim_tree()
+	if len(tree.root.children) == 0 {
+		if err := tree.root.expandNode(); err != nil {
+			return rules.SnakeMove{}, err
+		}
 	}
-	tree.root.expandNode()
-	for i := 0; i < iterations; i++ {
-		tree.expand_tree()
+	tree.prune_root()
+	if err := tree.search(tree.config.iterations); err != nil {
+		return rules.SnakeMove{}, err
 	}
 
-	return tree.root.select_best_move(tree.player, tree.name)
+	return tree.root.select_best_move(tree.player, tree.name), nil
+}
+
+// prune_root drops our moves into pockets too small for us before searching,
+// so no time is wasted on them. The simultaneous root can only be pruned before
+// it has children, they are keyed by the index of each snake's move.
+func (tree *Tree) prune_root() {
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		root := tree.joint_root
+		if len(root.children) > 0 {
+			return
+		}
+		for i, player := range root.players {
+			if player != tree.player {
+				continue
+			}
+			moves := []rules.SnakeMove{}
+			for _, arm := range root.arms[i] {
+				moves = append(moves, arm.move)
+			}
+			kept := prune_moves(&root.board, tree.player, moves)
+			arms := []Arm{}
+			for _, arm := range root.arms[i] {
+				if contains_move(kept, arm.move) {
+					arms = append(arms, arm)
+				}
+			}
+			root.arms[i] = arms
+		}
+		return
+	}
+
+	moves := []rules.SnakeMove{}
+	for _, child := range tree.root.children {
+		moves = append(moves, child.action)
+	}
+	kept := prune_moves(tree.root.board, tree.player, moves)
+	children := []*Node{}
+	for _, child := range tree.root.children {
+		if contains_move(kept, child.action) {
+			children = append(children, child)
+		} else {
+			tree.root.pool.release(child)
+		}
+	}
+	tree.root.children = children
+}
+
+func contains_move(moves []rules.SnakeMove, move rules.SnakeMove) bool {
+	for _, other := range moves {
+		if other == move {
+			return true
+		}
+	}
+	return false
+}
+
+// configure sets up the search from the tree's configuration, which has been
+// validated already.
+func (tree *Tree) configure() {
+	tree.workers = tree.config.workers
+	tree.rollout_depth = tree.config.rollout_depth
+	tree.rewards = RewardSettings{tie: tree.config.tie_reward, survival: tree.config.survival_reward}
+
+	if rollout, err := parse_rollout_policy(tree.config.rollout_policy); err == nil {
+		tree.rollout = rollout
+	}
+	if evaluator, err := parse_evaluator(tree.config.evaluator); err == nil {
+		tree.evaluator = evaluator
+	}
+	if selection, err := parse_selection_policy(tree.config.selection, tree.config.exploration, tree.rng); err == nil {
+		tree.selection = selection
+	}
+}
+
+// reseed starts the tree's generator over from seed for the next search.
+func (tree *Tree) reseed(seed int64) {
+	tree.seed = seed
+	tree.rng.Seed(seed)
+}
+
+// search runs tree.workers goroutines over the shared tree until the deadline.
+// iterations only caps the search, the deadline is what normally stops it.
+// A cap of zero searches until the deadline. The first error stops every
+// worker and is returned.
+func (tree *Tree) search(iterations int) error {
+	var wg sync.WaitGroup
+	var claimed int
+	var completed int
+	var failed error
+	var claim_lock sync.Mutex
+	tree.depth = 0
+
+	claim := func() bool {
+		claim_lock.Lock()
+		defer claim_lock.Unlock()
+		if failed != nil || (iterations > 0 && claimed >= iterations) {
+			return false
+		}
+		claimed += 1
+		return true
+	}
+
+	for w := 0; w < tree.workers; w++ {
+		wg.Add(1)
+		rng := worker_rand(tree.seed, w)
+		go func() {
+			defer wg.Done()
+			// A panic in a worker can't be recovered by the request handler,
+			// so it fails the search instead of taking down the server.
+			defer func() {
+				if r := recover(); r != nil {
+					claim_lock.Lock()
+					failed = fmt.Errorf("search panicked: %v", r)
+					claim_lock.Unlock()
+				}
+			}()
+			for time.Now().Before(tree.deadline) && claim() {
+				finished, err := tree.expand_tree(rng)
+				claim_lock.Lock()
+				if finished {
+					completed += 1
+				}
+				if err != nil && failed == nil {
+					failed = err
+				}
+				claim_lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	tree.iterations = completed
+	return failed
 }
 
 func (node *Node) recur_print() {
 
-	if !DEBUG_MODE {
+	if config.log_level != LOG_DEBUG {
 		return
 	}
 
-	snake := get_snake(node.board.board, node.action.ID).Body[0]
-	println("player:", node.player, "moved", node.action.Move, "wins:", node.wins, "sims:", node.sims, "position", snake.X, snake.Y)
-	printMap(&node.board.board)
+	board, err := node.simulation()
+	if err != nil {
+		return
+	}
+	snake := get_snake(board.board, node.action.ID).Body[0]
+	println("player:", node.player, "moved", node.action.Move, "wins:", node.value(), "sims:", node.sims, "position", snake.X, snake.Y)
+	printMap(&board.board)
 
 	if len(node.children) == 0 {
-		for _, snake := range node.board.board.Snakes {
+		for _, snake := range board.board.Snakes {
 
 			println("snake", snake.ID, "eliminated by", snake.EliminatedCause, snake.EliminatedBy, snake.EliminatedOnTurn, "snake length", len(snake.Body))
 		}
@@ -114,7 +332,7 @@ func (node *Node) recur_print() {
 	println("child: {")
 	best_node := node.children[0]
 	for _, child := range node.children {
-		println("move", child.action.Move, "[", child.wins, ",", child.sims, "]")
+		println("move", child.action.Move, "[", child.value(), ",", child.sims, "]")
 		if child.sims > best_node.sims {
 			best_node = child
 		}
@@ -128,156 +346,258 @@ func (node *Node) select_best_move(snake_id string, name string) rules.SnakeMove
 	best_node := node.children[0]
 
 	for _, child := range node.children {
-		println(child.action.Move, child.sims, child.wins)
-
 		val := child.sims
 		if val > best_node.sims {
 			best_node = child
 		}
 	}
 
-	println(name, "selected best move", best_node.action.Move, "on turn", node.board.board.Turn)
-
-	for _, food := range node.board.board.Food {
-		println("food loc (", food.X, food.Y, ")")
-	}
+	logf(LOG_DEBUG, "%s selected best move %s on turn %d", name, best_node.action.Move, node.board.board.Turn)
 	best_node.recur_print()
 	return best_node.action
 }
 
-func (tree *Tree) expand_tree() {
-	var promising_node = tree.root.select_node()
+func (tree *Tree) rollout_settings(rng *rand.Rand) RolloutSettings {
+	return RolloutSettings{
+		deadline:  tree.deadline,
+		policy:    tree.rollout,
+		rng:       rng,
+		max_depth: tree.rollout_depth,
+		evaluate:  tree.evaluator,
+		rewards:   tree.rewards,
+		fast:      tree.config.engine == ENGINE_FAST,
+	}
+}
 
-	promising_node.expandNode()
+// expand_tree runs one iteration of the search, rng is the generator of the
+// worker running it. It returns false if the play out ran out of time.
+func (tree *Tree) expand_tree(rng *rand.Rand) (bool, error) {
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		return tree.expand_joint_tree(rng)
+	}
+
+	test_node, board, err := tree.select_leaf()
+	if err != nil {
+		return false, err
+	}
+
+	rewards, finished, err := test_node.play_out(board, tree.rollout_settings(rng))
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	if finished {
+		test_node.back_prop(rewards)
+	} else {
+		test_node.unvisit()
+	}
+	return finished, err
+}
+
+// select_leaf picks the node to play out from and its board, expanding the
+// tree on the way there. The tree is unlocked again even if it panics, so the
+// other workers don't wait on it forever.
+func (tree *Tree) select_leaf() (*Node, Simulation, error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	var promising_node = tree.root.select_node(tree.selection)
+
+	// The board is replayed once, for both the expansion and the play out.
+	board, err := promising_node.simulation()
+	if err == nil {
+		err = promising_node.expand(&board)
+	}
+	if err != nil {
+		return nil, Simulation{}, err
+	}
 
 	var test_node = promising_node
 
 	if len(promising_node.children) > 0 {
-		test_node = promising_node.children[rand.Intn(len(promising_node.children))]
+		test_node = promising_node.children[tree.rng.Intn(len(promising_node.children))]
+		if err := test_node.step(&board); err != nil {
+			return nil, Simulation{}, err
+		}
+	}
+	// A finished game is never expanded, the search only comes back to it, so
+	// it keeps its board rather than replaying it every time.
+	if test_node.board == nil && board.is_game_over() {
+		kept := board.copy()
+		test_node.board = &kept
+	}
+
+	depth := 0
+	for above := test_node; above != tree.root; above = above.parent {
+		depth += 1
 	}
+	tree.depth = max_int(tree.depth, depth)
 
-	test_node.play_out()
+	// Counting the visit before the rollout finishes is a virtual loss: the
+	// path looks worse to the other workers, so they spread out over the tree.
+	test_node.visit()
+	return test_node, board, nil
 }
 
-func (node *Node) expandNode() {
+// expandNode adds a child for every move of the next player. Once the tree's
+// node budget is used up nodes are no longer expanded, the search then plays
+// out from the leaves it has.
+func (node *Node) expandNode() error {
+	board, err := node.simulation()
+	if err != nil {
+		return err
+	}
+	return node.expand(&board)
+}
 
+// expand is expandNode with the node's board already worked out.
+func (node *Node) expand(board *Simulation) error {
 	new_player := node.get_next_player(node.player)
-	move_matrix := node.board.getValidMoves(new_player)
-	for _, joint_move := range move_matrix {
-		node.children = append(node.children, create_child(node, joint_move, node.board, new_player))
+	move_matrix := board.getValidMoves(new_player)
+	if !node.pool.fits(len(move_matrix)) {
+		return nil
 	}
-
+	priors := move_priors(board, new_player, move_matrix)
+	for i, joint_move := range move_matrix {
+		child := create_child(node, joint_move, new_player)
+		child.prior = priors[i]
+		node.children = append(node.children, child)
+	}
+	return nil
 }
 
-func (node *Node) select_node() *Node {
+func (node *Node) select_node(policy SelectionPolicy) *Node {
 
 	if len(node.children) > 0 {
-		var max_val float64 = 0
+		max_val := math.Inf(-1)
 		best_node := node.children[0]
 		for _, child := range node.children {
-			parent_sims := 1
-			if node.parent != nil {
-				parent_sims = node.parent.sims
-			}
-			val := calc_utc_val(child.wins, child.sims, parent_sims)
+			val := policy.score(child.stats(), node.sims)
 			if val > max_val {
 				max_val = val
 				best_node = child
 			}
 		}
-		return best_node.select_node()
+		return best_node.select_node(policy)
 	}
 	return node
 }
 
-func calc_utc_val(wins int, sims int, parent_sims int) float64 {
-	if sims == 0 {
-		return math.MaxInt
+func (node *Node) stats() ArmStats {
+	return ArmStats{
+		sims:     node.sims,
+		value:    node.value(),
+		sq_value: node.sq_value,
+		prior:    node.prior,
 	}
-	discover := (c * math.Sqrt(math.Log((float64)(parent_sims+1))/(float64)(sims)))
-	reward := ((float64)(wins) / (float64)(sims))
-	return reward + discover
-
 }
 
-func (node *Node) play_out() {
+// play_out returns the rewards of a game from this node, played on its board,
+// with every snake moving according to the rollout policy. Games that reach
+// the depth cap are scored by the evaluator at the end of a rotation, so every
+// snake has moved the same number of times. It gives up once the deadline
+// passes, so a half finished game never counts towards the statistics.
+func (node *Node) play_out(copy_board Simulation, settings RolloutSettings) (map[string]float64, bool, error) {
 	iterations := 0
-	copy_board := node.board.copy()
-	game_over, _ := node.board.rules_set.IsGameOver(&copy_board.board)
-	copy_board.rules_set.FoodSpawnChance /= 2
+	game_over := copy_board.is_game_over()
 	copy_board.settings.FoodSpawnChance /= 2
+	copy_board.settings = copy_board.settings.WithRand(rules_rand{settings.rng})
 	current_turn := node.get_next_player(node.player)
+	record := new_rollout_record(&copy_board.board, copy_board.squads, settings.max_depth)
 
 	for !game_over {
 
-		check_game_over, _ := node.board.rules_set.IsGameOver(&copy_board.board)
+		check_game_over := copy_board.is_game_over()
 
 		if check_game_over {
 			break
 		}
 
+		if time.Now().After(settings.deadline) {
+			return nil, false, nil
+		}
+
+		at_rotation_start := current_turn == node.player_arr[0]
+		if settings.max_depth > 0 && at_rotation_start && iterations >= settings.max_depth*len(node.player_arr) {
+			return record.cutoff_rewards(&copy_board, settings.evaluate, settings.rewards), true, nil
+		}
+
+		// The FastBoard plays whole turns, so it takes over once the
+		// rotation has been finished.
+		if settings.fast && at_rotation_start && fast_supported(&copy_board) {
+			rewards, finished := fast_play_out(&copy_board, record, settings, iterations/len(node.player_arr))
+			return rewards, finished, nil
+		}
+
 		moves := copy_board.getValidMoves(current_turn)
 
+		// Only eliminated snakes have no moves, and their move is ignored.
 		if len(moves) == 0 {
 			moves = append(moves, rules.SnakeMove{Move: rules.MoveDown, ID: current_turn})
 		}
 
-		selected_move := moves[rand.Intn(len(moves))]
+		selected_move := settings.policy.choose_move(settings.rng, &copy_board, current_turn, moves)
 		last_in_rotation := node.player_order[current_turn] == (len(node.player_arr) - 1)
 		new_game_over, new_board, err := copy_board.executeAction(selected_move, last_in_rotation)
+		if err != nil {
+			return nil, false, fmt.Errorf("playing out: %w", err)
+		}
 		copy_board.board = *new_board
+		// Snakes are only eliminated once a rotation is finished, and the
+		// record counts turns like the FastBoard's.
+		if last_in_rotation {
+			record.advance(&copy_board.board)
+		}
 		game_over = new_game_over
 		current_turn = node.get_next_player(current_turn)
-
-		if err != nil {
-			println(err.Error())
-			panic("error thrown while playing out")
-		}
 		iterations += 1
 	}
-	winner := get_winner(copy_board.board.Snakes)
-	node.back_prop(winner)
+	return record.game_rewards(settings.rewards), true, nil
+}
 
+// value is the total reward of the player who moved into this node.
+func (node *Node) value() float64 {
+	return node.rewards[node.player_order[node.player]]
 }
 
-func get_winner(snakes []rules.Snake) string {
+func (node *Node) visit() {
+	node.sims += 1
 
-	for _, snake := range snakes {
-		if len(snake.EliminatedCause) == 0 {
-			return snake.ID
-		}
+	if node.parent != nil {
+		node.parent.visit()
 	}
-	return "tie"
 }
 
-func (node *Node) back_prop(winner string) {
-
-	if node.player == winner {
-		node.wins += 1
-	}
-	node.sims += 1
+func (node *Node) unvisit() {
+	node.sims -= 1
 
 	if node.parent != nil {
-		node.parent.back_prop(winner)
+		node.parent.unvisit()
 	}
 }
 
-func create_child(parent *Node, action rules.SnakeMove, board Simulation, player string) *Node {
+// back_prop credits each node with the reward of the player who moved into
+// it. The visits were already counted when the rollout started.
+func (node *Node) back_prop(rewards map[string]float64) {
 
-	board_copy := board.copy()
-	last_in_rotation := parent.player_order[player] == (len(parent.player_arr) - 1)
-	_, new_board, _ := board_copy.executeAction(action, last_in_rotation)
-	board_copy.board = *new_board
+	for i, player := range node.player_arr {
+		node.rewards[i] += rewards[player]
+	}
+	node.sq_value += rewards[node.player] * rewards[node.player]
 
-	return &Node{
-		player_order: parent.player_order,
-		player_arr:   parent.player_arr,
-		sims:         0,
-		wins:         0,
-		action:       action,
-		children:     []*Node{},
-		parent:       parent,
-		board:        board_copy,
-		player:       player,
+	if node.parent != nil {
+		node.parent.back_prop(rewards)
 	}
 }
+
+// create_child is a node for the player's action from parent. Its board is
+// left for simulation to work out.
+func create_child(parent *Node, action rules.SnakeMove, player string) *Node {
+	child := parent.pool.get()
+	child.player_order = parent.player_order
+	child.player_arr = parent.player_arr
+	child.rewards = append(child.rewards, make([]float64, len(parent.player_arr))...)
+	child.action = action
+	child.parent = parent
+	child.pool = parent.pool
+	child.player = player
+	return child
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 const ServerID = "BattlesnakeOfficial/starter-snake-go"
@@ -107,6 +108,7 @@ func HandleStart(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&state)
 	if err != nil {
 		log.Printf("ERROR: Failed to decode start json, %s", err)
+		metrics.decode_errors.add("start", 1)
 		return
 	}
 
@@ -120,10 +122,17 @@ func HandleMove(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&state)
 	if err != nil {
 		log.Printf("ERROR: Failed to decode move json, %s", err)
+		metrics.decode_errors.add("move", 1)
 		return
 	}
 
-	response := move(state)
+	// A seed sent with the request replays the search that produced a move.
+	seed, err := strconv.ParseInt(r.Header.Get(SEED_HEADER), 10, 64)
+	if err != nil {
+		seed = 0
+	}
+
+	response := answer_move(state, seed)
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
@@ -138,6 +147,7 @@ func HandleEnd(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&state)
 	if err != nil {
 		log.Printf("ERROR: Failed to decode end json, %s", err)
+		metrics.decode_errors.add("end", 1)
 		return
 	}
 
@@ -165,6 +175,7 @@ func start_server() {
 	http.HandleFunc("/start", withServerID(HandleStart))
 	http.HandleFunc("/move", withServerID(HandleMove))
 	http.HandleFunc("/end", withServerID(HandleEnd))
+	http.HandleFunc("/metrics", withServerID(HandleMetrics))
 
 	log.Printf("Starting Battlesnake Server at http://0.0.0.0:%s...\n", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Every move produces a DecisionRecord describing the search behind it. The
+// records are logged as single line JSON, and appended to config.decision_log
+// when it is set, so whole tournaments can be analysed afterwards. Only what
+// the tree already knows is taken while answering the move, the rest of the
+// record is worked out and written in the background.
+
+type DecisionRecord struct {
+	GameID     string        `json:"game_id"`
+	Turn       int           `json:"turn"`
+	Seed       int64         `json:"seed"`
+	Mode       string        `json:"mode"`
+	Iterations int           `json:"iterations"`
+	ElapsedMS  float64       `json:"elapsed_ms"`
+	Depth      int           `json:"depth"`
+	Nodes      int           `json:"nodes"`
+	Children   []ChildRecord `json:"children"`
+	Move       string        `json:"move"`
+
+	// Territory and Food are the cells and food each snake controls on the
+	// board searched from, see voronoi.
+	Territory map[string]int `json:"territory"`
+	Food      map[string]int `json:"food"`
+}
+
+// ChildRecord is one of our moves at the root. WinRate is our average reward
+// over the simulations through it.
+type ChildRecord struct {
+	Move    string  `json:"move"`
+	Visits  int     `json:"visits"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// DECISION_QUEUE is how many records can wait to be written. Records that
+// don't fit are dropped rather than holding up a move.
+const DECISION_QUEUE = 64
+
+// pending_decision is a record waiting to be written, with the settings it
+// is written by taken when the move was answered.
+type pending_decision struct {
+	record DecisionRecord
+	state  GameState
+	logged bool
+	path   string
+}
+
+var decisions = struct {
+	start   sync.Once
+	queue   chan pending_decision
+	pending sync.WaitGroup
+}{queue: make(chan pending_decision, DECISION_QUEUE)}
+
+func (tree *Tree) decision_record(state GameState, move string, elapsed time.Duration) DecisionRecord {
+	record := DecisionRecord{
+		GameID:     state.Game.ID,
+		Turn:       state.Turn,
+		Seed:       tree.seed,
+		Mode:       tree.mode,
+		Iterations: tree.iterations,
+		ElapsedMS:  float64(elapsed) / float64(time.Millisecond),
+		Children:   []ChildRecord{},
+		Move:       move,
+	}
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	record.Depth = tree.depth
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		record.Nodes = tree.joint_root.size
+		for i, player := range tree.joint_root.players {
+			if player != tree.player {
+				continue
+			}
+			for _, arm := range tree.joint_root.arms[i] {
+				record.Children = append(record.Children, ChildRecord{
+					Move:    arm.move.Move,
+					Visits:  arm.sims,
+					WinRate: win_rate(arm.wins, arm.sims),
+				})
+			}
+		}
+		return record
+	}
+
+	record.Nodes = tree.root.pool.live
+	for _, child := range tree.root.children {
+		record.Children = append(record.Children, ChildRecord{
+			Move:    child.action.Move,
+			Visits:  child.sims,
+			WinRate: win_rate(child.value(), child.sims),
+		})
+	}
+	return record
+}
+
+// territory fills in the territory on the board of the request searched from.
+func (record *DecisionRecord) territory(state GameState) {
+	sim := simulationFromGame(&state)
+	territory := voronoi(&sim.board, sim.ruleset == rules.GameTypeWrapped)
+	record.Territory, record.Food = territory.cells, territory.food
+}
+
+func win_rate(wins float64, sims int) float64 {
+	if sims == 0 {
+		return 0
+	}
+	return wins / float64(sims)
+}
+
+// log_decision hands the record of the move answering state to the decision
+// writer, which is started the first time.
+func log_decision(state GameState, record DecisionRecord) {
+	decisions.start.Do(func() { go write_decisions() })
+	decisions.pending.Add(1)
+	select {
+	case decisions.queue <- pending_decision{record, state, logging(LOG_INFO), config.decision_log}:
+	default:
+		decisions.pending.Done()
+		logf(LOG_ERROR, "ERROR: Dropped the decision record of %s turn %d, the log is behind", state.Game.ID, state.Turn)
+	}
+}
+
+// wait_decisions returns once every record handed to log_decision is written.
+func wait_decisions() {
+	decisions.pending.Wait()
+}
+
+func write_decisions() {
+	for decision := range decisions.queue {
+		decision.record.territory(decision.state)
+		decision.write()
+		decisions.pending.Done()
+	}
+}
+
+// write logs the record and appends it to the decision log, if any. Errors
+// are always logged.
+func (decision *pending_decision) write() {
+	line, err := json.Marshal(decision.record)
+	if err != nil {
+		log.Printf("ERROR: Failed to encode decision record, %s", err)
+		return
+	}
+	if decision.logged {
+		log.Printf("%s", line)
+	}
+
+	if decision.path == "" {
+		return
+	}
+	file, err := os.OpenFile(decision.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("ERROR: Failed to open decision log, %s", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("ERROR: Failed to write decision log, %s", err)
+	}
+}
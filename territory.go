@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// In games with several snakes, room alone doesn't say who is ahead: the open
+// board is shared. Territory splits it up with a Voronoi partition, every cell
+// belongs to the snake whose head gets there first.
+
+const EVAL_VORONOI = "voronoi"
+
+// Territory is how many cells and how much food each living snake controls.
+type Territory struct {
+	cells map[string]int
+	food  map[string]int
+}
+
+// claim is the best claim on a cell so far in a step of voronoi.
+type claim struct {
+	snake  int
+	length int
+}
+
+const (
+	UNCLAIMED = -1
+	CONTESTED = -2
+)
+
+// voronoi grows every living snake's head outwards a step at a time, all at
+// once. A cell goes to the first snake to reach it, once its body is out of
+// the way. When several arrive together the longest takes it, and snakes of
+// the same length leave it to nobody.
+func voronoi(board *rules.BoardState, wrapped bool) Territory {
+	territory := Territory{cells: map[string]int{}, food: map[string]int{}}
+	free_at := free_times(board)
+	owner := make([]int, len(free_at))
+	for cell := range owner {
+		owner[cell] = UNCLAIMED
+	}
+
+	snakes := []*rules.Snake{}
+	frontier := []int{}
+	for i := range board.Snakes {
+		snake := &board.Snakes[i]
+		if snake.EliminatedCause != rules.NotEliminated || len(snake.Body) == 0 {
+			continue
+		}
+		territory.cells[snake.ID] = 0
+		territory.food[snake.ID] = 0
+		head := snake.Body[0]
+		if head.X < 0 || head.X >= board.Width || head.Y < 0 || head.Y >= board.Height {
+			continue
+		}
+		owner[head.Y*board.Width+head.X] = len(snakes)
+		frontier = append(frontier, head.Y*board.Width+head.X)
+		snakes = append(snakes, snake)
+	}
+
+	for turn := 1; len(frontier) > 0; turn++ {
+		claims := map[int]claim{}
+		for _, cell := range frontier {
+			claimant := owner[cell]
+			point := rules.Point{X: cell % board.Width, Y: cell / board.Width}
+			for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+				next := move_point(point, dir)
+				if wrapped {
+					next.X = (next.X + board.Width) % board.Width
+					next.Y = (next.Y + board.Height) % board.Height
+				}
+				if next.X < 0 || next.X >= board.Width || next.Y < 0 || next.Y >= board.Height {
+					continue
+				}
+				index := next.Y*board.Width + next.X
+				if owner[index] != UNCLAIMED || free_at[index] > turn {
+					continue
+				}
+
+				current, claimed := claims[index]
+				length := len(snakes[claimant].Body)
+				switch {
+				case !claimed || length > current.length:
+					claims[index] = claim{claimant, length}
+				case length == current.length && current.snake != claimant:
+					claims[index] = claim{CONTESTED, length}
+				}
+			}
+		}
+
+		frontier = []int{}
+		for cell, best := range claims {
+			owner[cell] = best.snake
+			if best.snake == CONTESTED {
+				continue
+			}
+			frontier = append(frontier, cell)
+			territory.cells[snakes[best.snake].ID] += 1
+		}
+	}
+
+	for _, food := range board.Food {
+		if food.X < 0 || food.X >= board.Width || food.Y < 0 || food.Y >= board.Height {
+			continue
+		}
+		if claimant := owner[food.Y*board.Width+food.X]; claimant >= 0 {
+			territory.food[snakes[claimant].ID] += 1
+		}
+	}
+	return territory
+}
+
+// voronoi_eval is heuristic_eval with the room a snake has replaced by the
+// share of the board and the food it controls.
+func voronoi_eval(sim *Simulation) map[string]float64 {
+	board := &sim.board
+	territory := voronoi(board, sim.ruleset == rules.GameTypeWrapped)
+	longest := 1
+	claimed := 0
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause == rules.NotEliminated {
+			longest = max_int(longest, len(snake.Body))
+			claimed += territory.cells[snake.ID]
+		}
+	}
+
+	scores := map[string]float64{}
+	total := 0.0
+	for _, snake := range board.Snakes {
+		if snake.EliminatedCause != rules.NotEliminated {
+			continue
+		}
+		score := 0.4*float64(territory.cells[snake.ID])/float64(max_int(claimed, 1)) +
+			0.3*float64(len(snake.Body))/float64(longest) +
+			0.2*float64(snake.Health)/rules.SnakeMaxHealth +
+			0.1*float64(territory.food[snake.ID])/float64(max_int(len(board.Food), 1))
+
+		scores[snake.ID] = math.Exp(score / HEURISTIC_TEMPERATURE)
+		total += scores[snake.ID]
+	}
+
+	for id := range scores {
+		scores[id] /= total
+	}
+	return scores
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The engine gives us game.timeout milliseconds per move, measured from when it
+// sends the request to when it reads our response. The latency it reports for
+// our snake is that whole round trip for the previous turn, so subtracting the
+// time we spent searching on that turn leaves the network overhead.
+
+const (
+	DEFAULT_TIMEOUT_MS = 500
+	SAFETY_MARGIN_MS   = 60
+	MIN_BUDGET_MS      = 10
+)
+
+var search_times = struct {
+	sync.Mutex
+	last     map[string]time.Duration
+	recorded map[string]time.Time
+}{last: map[string]time.Duration{}, recorded: map[string]time.Time{}}
+
+func move_budget(game GameState) time.Duration {
+	timeout := time.Duration(game.Game.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT_MS * time.Millisecond
+	}
+
+	budget := timeout - network_latency(game) - SAFETY_MARGIN_MS*time.Millisecond
+	if config.time_budget > 0 && config.time_budget < budget {
+		budget = config.time_budget
+	}
+	if budget < MIN_BUDGET_MS*time.Millisecond {
+		budget = MIN_BUDGET_MS * time.Millisecond
+	}
+	return budget
+}
+
+func network_latency(game GameState) time.Duration {
+	latency_ms, err := strconv.Atoi(game.You.Latency)
+	if err != nil || latency_ms <= 0 {
+		return 0
+	}
+	latency := time.Duration(latency_ms) * time.Millisecond
+
+	search_times.Lock()
+	searched := search_times.last[game.Game.ID]
+	search_times.Unlock()
+
+	if latency < searched {
+		return 0
+	}
+	return latency - searched
+}
+
+func record_search_time(game_id string, elapsed time.Duration) {
+	search_times.Lock()
+	search_times.last[game_id] = elapsed
+	search_times.recorded[game_id] = time.Now()
+	search_times.Unlock()
+}
+
+func forget_search_time(game_id string) {
+	search_times.Lock()
+	delete(search_times.last, game_id)
+	delete(search_times.recorded, game_id)
+	search_times.Unlock()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// Trees are kept between turns so the simulations from the previous move are
+// not thrown away. Each game owns one tree, created on /start and dropped on
+// /end. On every /move the subtree matching what actually happened is promoted
+// to the root. A game that never sends /end would keep its tree forever, so
+// every /start also drops the games that have been idle for IDLE_GAME_TIMEOUT.
+
+const IDLE_GAME_TIMEOUT = 10 * time.Minute
+
+var game_trees = struct {
+	sync.Mutex
+	trees map[string]*Tree
+	used  map[string]time.Time
+}{trees: map[string]*Tree{}, used: map[string]time.Time{}}
+
+func cache_tree(game_id string, tree *Tree) {
+	game_trees.Lock()
+	game_trees.trees[game_id] = tree
+	game_trees.used[game_id] = time.Now()
+	game_trees.Unlock()
+}
+
+func cached_tree(game_id string) *Tree {
+	game_trees.Lock()
+	defer game_trees.Unlock()
+	tree := game_trees.trees[game_id]
+	if tree != nil {
+		game_trees.used[game_id] = time.Now()
+	}
+	return tree
+}
+
+func drop_tree(game_id string) {
+	game_trees.Lock()
+	delete(game_trees.trees, game_id)
+	delete(game_trees.used, game_id)
+	game_trees.Unlock()
+}
+
+// evict_idle_games drops the trees and search times of the games that haven't
+// been used since cutoff.
+func evict_idle_games(cutoff time.Time) {
+	game_trees.Lock()
+	for game_id, used := range game_trees.used {
+		if used.Before(cutoff) {
+			delete(game_trees.trees, game_id)
+			delete(game_trees.used, game_id)
+		}
+	}
+	game_trees.Unlock()
+
+	search_times.Lock()
+	for game_id, recorded := range search_times.recorded {
+		if recorded.Before(cutoff) {
+			delete(search_times.last, game_id)
+			delete(search_times.recorded, game_id)
+		}
+	}
+	search_times.Unlock()
+}
+
+// game_tree returns the cached tree for the game advanced to the observed
+// state, or a fresh tree when nothing in the cache matches.
+func game_tree(game GameState) *Tree {
+	tree := cached_tree(game.Game.ID)
+	if tree != nil && tree.advance(game) {
+		return tree
+	}
+
+	fresh := new_tree(game, config)
+	cache_tree(game.Game.ID, fresh)
+	return fresh
+}
+
+// advance promotes the node matching the observed game state to the root. It
+// returns false when the state can't be found in the tree, e.g. because a snake
+// was eliminated, a turn was skipped, or that part of the tree was never expanded.
+func (tree *Tree) advance(game GameState) bool {
+	if tree.mode == SEARCH_SIMULTANEOUS {
+		return tree.advance_joint(game)
+	}
+
+	observed := search_board(game, tree.config)
+
+	switch game.Turn {
+	case tree.turn:
+		_, ok := boards_match(tree.root.board.board, observed.board)
+		return ok
+	case tree.turn + 1:
+	default:
+		return false
+	}
+
+	if len(observed.board.Snakes) != len(tree.root.player_arr) {
+		return false
+	}
+
+	// One turn is a full rotation through player_arr, starting with us.
+	node := tree.root
+	board := *tree.root.board
+	for _, player := range tree.root.player_arr {
+		move, ok := board.observed_move(observed.board, player)
+		if !ok {
+			return false
+		}
+		node = node.find_child(move)
+		if node == nil {
+			return false
+		}
+		var err error
+		if board, err = node.simulation(); err != nil {
+			return false
+		}
+	}
+
+	// Food that spawned is on the observed board, which every board in the
+	// subtree is replayed from once it is the root.
+	if _, ok := boards_match(board.board, observed.board); !ok {
+		return false
+	}
+
+	// The rest of the old tree goes back to the pool.
+	siblings := node.parent.children
+	for i, child := range siblings {
+		if child == node {
+			node.parent.children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	node.parent = nil
+	observed.settings = observed.settings.WithSeed(tree.root.board.settings.Seed())
+	node.pool.release(tree.root)
+	node.board = &observed
+	tree.root = node
+	tree.turn = game.Turn
+	return true
+}
+
+// advance_joint is advance for the simultaneous tree, where a turn is a single
+// joint move rather than a rotation.
+func (tree *Tree) advance_joint(game GameState) bool {
+	observed := search_board(game, tree.config)
+
+	switch game.Turn {
+	case tree.turn:
+		_, ok := boards_match(tree.joint_root.board.board, observed.board)
+		return ok
+	case tree.turn + 1:
+	default:
+		return false
+	}
+
+	root := tree.joint_root
+	picked := make([]int, len(root.players))
+	for i, player := range root.players {
+		move, ok := root.board.observed_move(observed.board, player)
+		if !ok {
+			return false
+		}
+		picked[i] = -1
+		for j, arm := range root.arms[i] {
+			if arm.move.Move == move {
+				picked[i] = j
+			}
+		}
+		if picked[i] < 0 {
+			return false
+		}
+	}
+
+	node, ok := root.children[joint_key(picked)]
+	if !ok {
+		return false
+	}
+
+	spawned, ok := boards_match(node.board.board, observed.board)
+	if !ok {
+		return false
+	}
+	if len(spawned) > 0 {
+		node.add_food(spawned)
+	}
+
+	node.parent = nil
+	node.picked = nil
+	node.board = observed
+	tree.joint_root = node
+	tree.turn = game.Turn
+	return true
+}
+
+func (node *Node) find_child(move string) *Node {
+	for _, child := range node.children {
+		if child.action.Move == move {
+			return child
+		}
+	}
+	return nil
+}
+
+// add_food places food that spawned in the real game on every board in the
+// subtree, so expansions below the new root see it.
+func (node *JointNode) add_food(food []rules.Point) {
+	node.board.board.Food = append(node.board.board.Food, food...)
+	for _, child := range node.children {
+		child.add_food(food)
+	}
+}
+
+// observed_move works out which way a snake moved from this board to after,
+// from where its head ended up.
+func (game *Simulation) observed_move(after rules.BoardState, snake_id string) (string, bool) {
+	prev := get_snake(game.board, snake_id)
+	next := get_snake(after, snake_id)
+	if prev == nil || next == nil || len(prev.Body) == 0 || len(next.Body) == 0 {
+		return "", false
+	}
+
+	for _, dir := range []string{rules.MoveUp, rules.MoveDown, rules.MoveLeft, rules.MoveRight} {
+		if game.neighbour(prev.Body[0], dir) == next.Body[0] {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// boards_match compares a simulated board with the observed one. Snakes must be
+// identical, and every simulated food must still be there. Any extra food on the
+// observed board spawned during the turn and is returned.
+func boards_match(simulated rules.BoardState, observed rules.BoardState) ([]rules.Point, bool) {
+	alive := 0
+	for _, snake := range simulated.Snakes {
+		if snake.EliminatedCause == rules.NotEliminated {
+			alive += 1
+		}
+	}
+	if alive != len(observed.Snakes) {
+		return nil, false
+	}
+
+	for _, snake := range observed.Snakes {
+		sim_snake := get_snake(simulated, snake.ID)
+		if sim_snake == nil || sim_snake.EliminatedCause != rules.NotEliminated {
+			return nil, false
+		}
+		if sim_snake.Health != snake.Health || len(sim_snake.Body) != len(snake.Body) {
+			return nil, false
+		}
+		for i := range snake.Body {
+			if sim_snake.Body[i] != snake.Body[i] {
+				return nil, false
+			}
+		}
+	}
+
+	// A change in hazards can't be patched into the subtree the way food is,
+	// the shrinking in it was predicted from the old hazards.
+	if len(simulated.Hazards) != len(observed.Hazards) {
+		return nil, false
+	}
+	for _, hazard := range observed.Hazards {
+		if count_points(simulated.Hazards, hazard) != count_points(observed.Hazards, hazard) {
+			return nil, false
+		}
+	}
+
+	spawned := []rules.Point{}
+	for _, food := range observed.Food {
+		if !contains_point(simulated.Food, food) {
+			spawned = append(spawned, food)
+		}
+	}
+	for _, food := range simulated.Food {
+		if !contains_point(observed.Food, food) {
+			return nil, false
+		}
+	}
+	return spawned, true
+}
+
+func contains_point(points []rules.Point, point rules.Point) bool {
+	for _, p := range points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/BattlesnakeOfficial/rules"
+)
+
+// body reads a snake's body from "x,y x,y ...", head first.
+func body(points string) []rules.Point {
+	body := []rules.Point{}
+	for _, point := range strings.Fields(points) {
+		x, y, _ := strings.Cut(point, ",")
+		p := rules.Point{}
+		parse_int(x, &p.X)
+		parse_int(y, &p.Y)
+		body = append(body, p)
+	}
+	return body
+}
+
+func Test_ValidMoves(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		snakes []rules.Snake
+		// want are the moves of the first snake, in any order.
+		want []string
+	}{
+		{
+			name:   "open board",
+			snakes: []rules.Snake{{ID: "a", Body: body("3,3 3,2 3,1")}},
+			want:   []string{rules.MoveUp, rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name:   "corner",
+			snakes: []rules.Snake{{ID: "a", Body: body("0,0 1,0 2,0")}},
+			want:   []string{rules.MoveUp},
+		},
+		{
+			name:   "own tail moves away",
+			snakes: []rules.Snake{{ID: "a", Body: body("3,3 3,2 2,2 2,3")}},
+			want:   []string{rules.MoveUp, rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name:   "own stacked tail stays",
+			snakes: []rules.Snake{{ID: "a", Body: body("3,3 3,2 2,2 2,3 2,3")}},
+			want:   []string{rules.MoveUp, rules.MoveRight},
+		},
+		{
+			name: "other's stacked tail stays",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("0,5 0,4 1,4 2,4 2,3 2,3")},
+			},
+			want: []string{rules.MoveUp, rules.MoveRight},
+		},
+		{
+			name: "other's body",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("5,4 4,4 3,4 2,4 1,4")},
+			},
+			want: []string{rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name: "head to head risk with a longer snake",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("5,3 6,3 6,2 6,1")},
+			},
+			want: []string{rules.MoveUp, rules.MoveLeft},
+		},
+		{
+			name: "head to head risk with a snake as long",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("3,5 3,6 4,6")},
+			},
+			want: []string{rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name: "shorter snakes lose the head to head",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("5,3 6,3")},
+			},
+			want: []string{rules.MoveUp, rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name: "head of a longer snake",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("4,3 5,3 6,3 6,2")},
+			},
+			want: []string{rules.MoveUp, rules.MoveLeft},
+		},
+		{
+			name: "only risky moves left",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("0,0 1,0 2,0")},
+				{ID: "b", Body: body("1,1 1,2 2,2 3,2")},
+			},
+			want: []string{rules.MoveUp},
+		},
+		{
+			name: "eliminated snakes are gone",
+			snakes: []rules.Snake{
+				{ID: "a", Body: body("3,3 3,2 3,1")},
+				{ID: "b", Body: body("2,4 3,4 4,4 4,3 4,2"), EliminatedCause: rules.EliminatedByCollision},
+			},
+			want: []string{rules.MoveUp, rules.MoveLeft, rules.MoveRight},
+		},
+		{
+			name:   "no valid move left",
+			snakes: []rules.Snake{{ID: "a", Body: body("0,0 1,0 1,1 0,1 0,2")}},
+			want:   []string{rules.MoveUp},
+		},
+		{
+			name:   "eliminated snakes can't move",
+			snakes: []rules.Snake{{ID: "a", Body: body("3,3 3,2 3,1"), EliminatedCause: rules.EliminatedByOutOfHealth}},
+			want:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		sim := Simulation{board: rules.BoardState{Width: 7, Height: 7, Snakes: test.snakes}}
+		for i := range sim.board.Snakes {
+			sim.board.Snakes[i].Health = 50
+		}
+
+		got := []string{}
+		for _, move := range sim.getValidMoves("a") {
+			got = append(got, move.Move)
+		}
+		sort.Strings(got)
+		want := append([]string{}, test.want...)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: expected %v, got %v", test.name, want, got)
+		}
+	}
+}